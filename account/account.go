@@ -20,6 +20,9 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net/http"
+	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/acme"
@@ -30,33 +33,33 @@ import (
 	"github.com/lscheidler/letsencrypt-lambda/provider"
 )
 
-const (
-	// staging
-	//DirectoryURL = "https://acme-staging-v02.api.letsencrypt.org/directory"
-	DirectoryURL = "https://acme-v02.api.letsencrypt.org/directory"
-)
-
 type Accounts []Account
 
 type Account struct {
-	Certificates     map[string]*certificate.Certificate `json:"certificates"`
-	Changed          bool                                `json:"-"`
-	ClientPassphrase *string                             `json:"-"`
-	Domains          []string                            `json:"-"`
-	Email            *string                             `json:"-"`
-	Registration     *registration.RegistrationCrypt     `json:"registration"`
-	client           *acme.Client
-	provider         *provider.Provider
+	Certificates           map[string]*certificate.Certificate `json:"certificates"`
+	CertificateConfigs     []certificate.Config                `json:"-"`
+	Changed                bool                                `json:"-"`
+	ClientPassphrase       *string                             `json:"-"`
+	DirectoryURL           string                              `json:"-"`
+	Email                  *string                             `json:"-"`
+	Exporter               certificate.Exporter                `json:"-"`
+	ExternalAccountBinding *acme.ExternalAccountBinding        `json:"-"`
+	HTTPClient             *http.Client                        `json:"-"`
+	Providers              map[string]provider.Provider        `json:"-"`
+	Registration           *registration.RegistrationCrypt     `json:"registration"`
+	client                 *acme.Client
+	provider               *provider.Provider
+	renewalInfoURL         string
 }
 
-func New(email *string, domains []string, provider *provider.Provider) *Account {
+func New(email *string, certificateConfigs []certificate.Config, provider *provider.Provider) *Account {
 	return &Account{
-		Certificates: map[string]*certificate.Certificate{},
-		Changed:      false,
-		Domains:      domains,
-		Email:        email,
-		Registration: &registration.RegistrationCrypt{},
-		provider:     provider,
+		Certificates:       map[string]*certificate.Certificate{},
+		CertificateConfigs: certificateConfigs,
+		Changed:            false,
+		Email:              email,
+		Registration:       &registration.RegistrationCrypt{},
+		provider:           provider,
 	}
 }
 
@@ -67,17 +70,29 @@ func (a *Account) Create() error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
 	defer cancel()
 
-	a.client = &acme.Client{
-		Key:          a.Registration.Key.Signer(),
-		DirectoryURL: DirectoryURL,
+	a.Registration.DirectoryURL = a.directoryURL()
+	a.newClient()
+
+	dir, err := a.client.Discover(ctx)
+	if err != nil {
+		return err
+	}
+	if dir.ExternalAccountRequired && a.ExternalAccountBinding == nil {
+		return fmt.Errorf("%s requires an external account binding", a.directoryURL())
 	}
 
-	acmeAccount := &acme.Account{Contact: []string{"mailto:" + *a.Email}}
+	acmeAccount := &acme.Account{
+		Contact:                []string{"mailto:" + *a.Email},
+		ExternalAccountBinding: a.ExternalAccountBinding,
+	}
 	reg, err := a.client.Register(ctx, acmeAccount, acme.AcceptTOS)
 	if err != nil {
 		return err
 	}
 
+	if a.ExternalAccountBinding != nil {
+		a.Registration.ExternalAccountBinding = a.ExternalAccountBinding.KID
+	}
 	a.Registration.Contact = reg.Contact
 	a.Registration.URI = reg.URI
 	a.Registration.OrdersURL = reg.OrdersURL
@@ -85,43 +100,225 @@ func (a *Account) Create() error {
 	return nil
 }
 
+// CreateOrRenewCertificates issues or renews all configured certificates.
+// A failure of one certificate doesn't stop the others, all failures are
+// returned together.
 func (a *Account) CreateOrRenewCertificates() error {
 	if a.client == nil {
 		return fmt.Errorf("acme.Client is not initialized")
 	}
+	if a.Registration.Status == acme.StatusDeactivated {
+		return fmt.Errorf("account %s is deactivated", *a.Email)
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
 	defer cancel()
 
-	var cert *certificate.Certificate
-	if cert = a.Certificates[fmt.Sprintf("%v", a.Domains)]; cert == nil {
-		cert = certificate.New(a.Domains)
-		a.Certificates[fmt.Sprintf("%v", a.Domains)] = cert
+	dir, err := a.client.Discover(ctx)
+	if err != nil {
+		return err
+	}
+
+	if dir.OrderURL == "" {
+		return fmt.Errorf("Pre-RFC legacy CA not supported")
+	}
+
+	if a.renewalInfoURL, err = a.discoverRenewalInfo(ctx); err != nil {
+		log.Println("Discover renewal info failed:", err)
+	}
+
+	var failed []string
+	for index := range a.CertificateConfigs {
+		config := &a.CertificateConfigs[index]
+		if err := a.createOrRenewCertificate(config, false); err != nil {
+			log.Printf("Certificate %s failed: %v", config.Name, err)
+			failed = append(failed, fmt.Sprintf("%s: %v", config.Name, err))
+		} else if err := a.exportCertificate(config); err != nil {
+			log.Printf("Export of certificate %s failed: %v", config.Name, err)
+			failed = append(failed, fmt.Sprintf("%s: export: %v", config.Name, err))
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d certificates failed: %s", len(failed), len(a.CertificateConfigs), strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// RolloverKey replaces the account key with a new key (RFC 8555 section
+// 7.3.5). The new key is persisted with save before the rollover and
+// promoted afterwards. An interrupted rollover reuses the persisted key, if
+// the acme server already identifies the account by the new key, the new key
+// is promoted without another rollover.
+func (a *Account) RolloverKey(save func(*Account) error) error {
+	if a.client == nil {
+		return fmt.Errorf("acme.Client is not initialized")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	registered := false
+	if a.Registration.NextKey == nil {
+		a.Registration.NextKey = privatekey.New()
+		a.Changed = true
+		if err := save(a); err != nil {
+			return err
+		}
 	} else {
-		now := time.Now()
-		if duration := cert.NotAfter.Sub(now).Hours(); duration >= 30*24 {
-			// if NotAfter is >= 30 days away, skip renew
-			log.Printf("The certificate is valid for %d days. Skipping renewal.", int(duration/24))
-			return nil
+		registered = a.nextKeyRegistered(ctx)
+	}
+
+	if registered {
+		// the previous rollover succeeded, but the new key wasn't saved
+		log.Println("New key is already the account key")
+	} else {
+		log.Println("AccountKeyRollover")
+		if err := a.client.AccountKeyRollover(ctx, a.Registration.NextKey.Signer()); err != nil {
+			return err
 		}
 	}
 
-	csr, err := cert.Request()
-	if err != nil {
-		return err
+	a.Registration.Key = a.Registration.NextKey
+	a.Registration.NextKey = nil
+	a.Changed = true
+	a.newClient()
+	return save(a)
+}
+
+// nextKeyRegistered returns true, if the acme server identifies the account
+// by the new key NextKey
+func (a *Account) nextKeyRegistered(ctx context.Context) bool {
+	client := &acme.Client{
+		Key:          a.Registration.NextKey.Signer(),
+		DirectoryURL: a.directoryURL(),
+		HTTPClient:   a.HTTPClient,
 	}
 
-	dir, err := a.client.Discover(ctx)
+	acct, err := client.GetReg(ctx, "")
 	if err != nil {
+		if err != acme.ErrNoAccount {
+			log.Println("Lookup of the account by the new key failed:", err)
+		}
+		return false
+	}
+	return acct.URI == a.Registration.URI
+}
+
+// Deactivate deactivates the account with the acme server. A deactivated
+// account can't be used anymore.
+func (a *Account) Deactivate() error {
+	if a.client == nil {
+		return fmt.Errorf("acme.Client is not initialized")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	log.Println("DeactivateReg")
+	if err := a.client.DeactivateReg(ctx); err != nil {
 		return err
 	}
 
-	if dir.OrderURL == "" {
-		log.Fatal("Pre-RFC legacy CA not supported")
+	a.Registration.Status = acme.StatusDeactivated
+	a.Changed = true
+	return nil
+}
+
+// RevokeCertificate revokes the certificate name with reason and reissues
+// it with a new private key, if reissue is true. An already revoked
+// certificate isn't revoked again, but reissued (e.g. after a failed
+// reissue).
+func (a *Account) RevokeCertificate(name string, reason acme.CRLReasonCode, signWithCertificateKey bool, reissue bool) error {
+	if a.client == nil {
+		return fmt.Errorf("acme.Client is not initialized")
+	}
+
+	cert := a.Certificates[name]
+	if cert == nil {
+		return fmt.Errorf("certificate %s not found", name)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	if cert.IsRevoked() {
+		if !reissue {
+			return fmt.Errorf("certificate %s is already revoked", name)
+		}
+		log.Printf("Certificate %s is already revoked", name)
+	} else {
+		log.Printf("Revoke certificate %s (reason %d)", name, reason)
+		if err := cert.Revoke(ctx, a.client, reason, signWithCertificateKey); err != nil {
+			return err
+		}
+		a.Changed = true
+
+		if !reissue {
+			return nil
+		}
+	}
+
+	for index := range a.CertificateConfigs {
+		if config := &a.CertificateConfigs[index]; config.Name == name {
+			if err := a.createOrRenewCertificate(config, true); err != nil {
+				return err
+			}
+			return a.exportCertificate(config)
+		}
+	}
+	return fmt.Errorf("certificate %s is not configured, can't reissue it", name)
+}
+
+func (a *Account) createOrRenewCertificate(config *certificate.Config, reissue bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	var cert *certificate.Certificate
+	var renewKey bool
+	if cert = a.Certificates[config.Name]; cert == nil || !cert.Matches(config) {
+		log.Printf("Create certificate %s for %v (%s)", config.Name, config.Domains, config.KeyType)
+		var err error
+		if cert, err = certificate.New(config.Domains, config.KeyType); err != nil {
+			return err
+		}
+		a.Certificates[config.Name] = cert
+	} else if cert.IsRevoked() {
+		if !reissue {
+			log.Printf("The certificate %s is revoked. Skipping renewal.", config.Name)
+			return nil
+		}
+		// the key of a revoked certificate may be compromised
+		log.Printf("Reissue certificate %s with a new private key", config.Name)
+		renewKey = true
+	} else if renewalTime := a.renewalTime(ctx, config, cert); time.Now().Before(renewalTime) {
+		log.Printf("The certificate %s is valid for %d days. Skipping renewal until %s.", config.Name, int(time.Until(cert.NotAfter).Hours()/24), renewalTime.Format(time.RFC3339))
+		return nil
+	} else if cert.KeyRotationDue(config) {
+		log.Printf("Renew certificate %s with a new private key (key policy %s)", config.Name, config.KeyPolicy)
+		renewKey = true
+	}
+
+	// the current key is only replaced, if the new certificate was issued
+	key := cert.Key
+	if renewKey {
+		var err error
+		if key, err = cert.NewKey(); err != nil {
+			return err
+		}
+	}
+
+	csr, err := cert.Request(key)
+	if err != nil {
+		return err
 	}
 
 	// verify domain
-	order, err := a.verify(ctx)
+	p, err := a.providerFor(config)
+	if err != nil {
+		return err
+	}
+	order, err := a.verify(ctx, config.Domains, p)
 	if err != nil {
 		return err
 	}
@@ -131,7 +328,7 @@ func (a *Account) CreateOrRenewCertificates() error {
 		return err
 	}
 
-	err = cert.Add(der)
+	err = cert.Add(der, key)
 	if err != nil {
 		return err
 	}
@@ -139,13 +336,24 @@ func (a *Account) CreateOrRenewCertificates() error {
 	return nil
 }
 
-func (a *Account) verify(ctx context.Context) (*acme.Order, error) {
+// providerFor returns the dns provider of the certificate config
+func (a *Account) providerFor(config *certificate.Config) (provider.Provider, error) {
+	if config.DNSProvider == "" {
+		return *a.provider, nil
+	}
+	if p, ok := a.Providers[config.DNSProvider]; ok {
+		return p, nil
+	}
+	return nil, fmt.Errorf("unknown dns provider %s", config.DNSProvider)
+}
+
+func (a *Account) verify(ctx context.Context, domains []string, p provider.Provider) (*acme.Order, error) {
 	var order *acme.Order
 	var err error
 
 	// get AuthorizeOrder for domain
-	log.Println("AuthorizeOrder", a.Domains)
-	if order, err = a.client.AuthorizeOrder(ctx, acme.DomainIDs(a.Domains...)); err != nil {
+	log.Println("AuthorizeOrder", domains)
+	if order, err = a.client.AuthorizeOrder(ctx, acme.DomainIDs(domains...)); err != nil {
 		return nil, err
 	}
 
@@ -168,6 +376,7 @@ func (a *Account) verify(ctx context.Context) (*acme.Order, error) {
 
 	// Satisfy all pending authorizations.
 	// https://github.com/golang/crypto/blob/5c72a883971a4325f8c62bf07b6d38c20ea47a6a/acme/autocert/autocert.go#L789
+	var pending []*acme.Authorization
 	for _, zurl := range order.AuthzURLs {
 		log.Println("GetAuthorization", zurl)
 		z, err := a.client.GetAuthorization(ctx, zurl)
@@ -178,27 +387,19 @@ func (a *Account) verify(ctx context.Context) (*acme.Order, error) {
 			// We are interested only in pending authorizations.
 			continue
 		}
+		pending = append(pending, z)
+	}
 
-		log.Println("Create challenge record for", z.Identifier.Value)
-		challenge := pickChallenge("dns-01", z.Challenges)
-		var token string
-		if token, err = a.client.DNS01ChallengeRecord(challenge.Token); err != nil {
-			return nil, err
-		}
-
-		// challenge fulfilment
-		(*a.provider).CreateChallenge("_acme-challenge."+z.Identifier.Value+".", token)
-
-		log.Println("Accept")
-		if _, err = a.client.Accept(ctx, challenge); err != nil {
+	if bp, ok := p.(provider.BatchProvider); ok {
+		if err = a.fulfilBatch(ctx, pending, bp); err != nil {
 			return nil, err
 		}
-		log.Println("WaitAuthorization")
-		if _, err = a.client.WaitAuthorization(ctx, z.URI); err != nil {
-			return nil, err
+	} else {
+		for _, z := range pending {
+			if err = a.fulfil(ctx, z, p); err != nil {
+				return nil, fmt.Errorf("authorization for %s failed: %v", z.Identifier.Value, err)
+			}
 		}
-
-		(*a.provider).RemoveChallenge("_acme-challenge."+z.Identifier.Value+".", token)
 	}
 
 	log.Println("WaitOrder")
@@ -209,6 +410,158 @@ func (a *Account) verify(ctx context.Context) (*acme.Order, error) {
 	return order, nil
 }
 
+// fulfil satisfies the dns-01 challenge of the pending authorization z.
+// The challenge is only accepted, if the challenge record could be created
+// and is propagated, to not waste failed authorizations.
+func (a *Account) fulfil(ctx context.Context, z *acme.Authorization, p provider.Provider) error {
+	log.Println("Create challenge record for", z.Identifier.Value)
+	challenge := pickChallenge("dns-01", z.Challenges)
+	if challenge == nil {
+		return fmt.Errorf("no dns-01 challenge offered")
+	}
+
+	token, err := a.client.DNS01ChallengeRecord(challenge.Token)
+	if err != nil {
+		return err
+	}
+
+	// challenge fulfilment
+	path := "_acme-challenge." + z.Identifier.Value + "."
+	if err = p.CreateChallenge(path, token); err != nil {
+		return fmt.Errorf("create challenge record: %v", err)
+	}
+	defer func() {
+		if err := p.RemoveChallenge(path, token); err != nil {
+			log.Println("Remove challenge record for", z.Identifier.Value, "failed:", err)
+		}
+	}()
+
+	log.Println("WaitForPropagation")
+	if err = p.WaitForPropagation(path, token); err != nil {
+		return fmt.Errorf("wait for challenge record propagation: %v", err)
+	}
+
+	log.Println("Accept")
+	if _, err = a.client.Accept(ctx, challenge); err != nil {
+		return err
+	}
+	log.Println("WaitAuthorization")
+	if _, err = a.client.WaitAuthorization(ctx, z.URI); err != nil {
+		return err
+	}
+	return nil
+}
+
+// fulfilBatch satisfies the dns-01 challenges of all pending authorizations
+// at once. The challenge records are created and removed together and the
+// challenges are accepted in parallel.
+func (a *Account) fulfilBatch(ctx context.Context, authzs []*acme.Authorization, p provider.BatchProvider) error {
+	if len(authzs) == 0 {
+		return nil
+	}
+
+	challenges := make([]*acme.Challenge, len(authzs))
+	records := make([]provider.Challenge, len(authzs))
+	for index, z := range authzs {
+		if challenges[index] = pickChallenge("dns-01", z.Challenges); challenges[index] == nil {
+			return fmt.Errorf("authorization for %s failed: no dns-01 challenge offered", z.Identifier.Value)
+		}
+
+		token, err := a.client.DNS01ChallengeRecord(challenges[index].Token)
+		if err != nil {
+			return fmt.Errorf("authorization for %s failed: %v", z.Identifier.Value, err)
+		}
+		records[index] = provider.Challenge{
+			Path:  "_acme-challenge." + z.Identifier.Value + ".",
+			Value: token,
+		}
+	}
+
+	// challenge fulfilment
+	log.Println("Create challenge records for", len(records), "authorizations")
+	if err := p.CreateChallenges(records); err != nil {
+		return fmt.Errorf("create challenge records: %v", err)
+	}
+	defer func() {
+		if err := p.RemoveChallenges(records); err != nil {
+			log.Println("Remove challenge records failed:", err)
+		}
+	}()
+
+	log.Println("WaitForChallenges")
+	if err := p.WaitForChallenges(records); err != nil {
+		return fmt.Errorf("wait for challenge record propagation: %v", err)
+	}
+
+	errs := make([]error, len(authzs))
+	var wg sync.WaitGroup
+	for index := range authzs {
+		wg.Add(1)
+		go func(index int) {
+			defer wg.Done()
+			z := authzs[index]
+
+			log.Println("Accept", z.Identifier.Value)
+			if _, err := a.client.Accept(ctx, challenges[index]); err != nil {
+				errs[index] = err
+				return
+			}
+			log.Println("WaitAuthorization", z.Identifier.Value)
+			if _, err := a.client.WaitAuthorization(ctx, z.URI); err != nil {
+				errs[index] = err
+			}
+		}(index)
+	}
+	wg.Wait()
+
+	for index, err := range errs {
+		if err != nil {
+			return fmt.Errorf("authorization for %s failed: %v", authzs[index].Identifier.Value, err)
+		}
+	}
+	return nil
+}
+
+// exportCertificate exports the certificate of config, if the current
+// certificate wasn't exported yet
+func (a *Account) exportCertificate(config *certificate.Config) error {
+	cert := a.Certificates[config.Name]
+	if !config.ACMExport || cert == nil || cert.Pem == nil || cert.IsRevoked() {
+		return nil
+	}
+	if cert.ACMCertificateArn != nil && cert.ACMImportedAt != nil && !cert.ACMImportedAt.Before(cert.CreatedAt) {
+		return nil
+	}
+	if a.Exporter == nil {
+		return fmt.Errorf("exporter is not initialized")
+	}
+
+	if err := a.Exporter.Export(config, cert); err != nil {
+		return err
+	}
+	now := time.Now()
+	cert.ACMImportedAt = &now
+	a.Changed = true
+	return nil
+}
+
+// renewalTime returns the time, when cert should be renewed. The renewal
+// window suggested by the CA (ACME Renewal Information) takes precedence
+// over the configured renewal time.
+func (a *Account) renewalTime(ctx context.Context, config *certificate.Config, cert *certificate.Certificate) time.Time {
+	if a.renewalInfoURL != "" && !config.DisableARI {
+		info, err := cert.RenewalInfo(ctx, a.HTTPClient, a.renewalInfoURL)
+		if err == nil {
+			if info.ExplanationURL != "" {
+				log.Printf("Renewal info for certificate %s: %s", config.Name, info.ExplanationURL)
+			}
+			return info.SelectTime()
+		}
+		log.Printf("Renewal info for certificate %s failed: %v", config.Name, err)
+	}
+	return cert.RenewalTime(config)
+}
+
 // deactivatePendingAuthz relinquishes all authorizations identified by the elements
 // of the provided uri slice which are in "pending" state.
 // It ignores revocation errors.
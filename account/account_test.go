@@ -0,0 +1,172 @@
+/*
+Copyright 2020 Lars Eric Scheidler
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package account
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/acme"
+
+	"github.com/lscheidler/letsencrypt-lambda/account/certificate/privatekey"
+	"github.com/lscheidler/letsencrypt-lambda/provider"
+)
+
+// batchProvider records the challenge records of a BatchProvider
+type batchProvider struct {
+	provider.Provider
+
+	created []provider.Challenge
+	removed []provider.Challenge
+	waitErr error
+}
+
+func (p *batchProvider) CreateChallenges(challenges []provider.Challenge) error {
+	p.created = append(p.created, challenges...)
+	return nil
+}
+
+func (p *batchProvider) WaitForChallenges(challenges []provider.Challenge) error {
+	return p.waitErr
+}
+
+func (p *batchProvider) RemoveChallenges(challenges []provider.Challenge) error {
+	p.removed = append(p.removed, challenges...)
+	return nil
+}
+
+// newACMEServer returns a minimal acme server, which accepts challenges and
+// authorizations. The challenges of rejected domains are rejected.
+func newACMEServer(t *testing.T, rejected ...string) *httptest.Server {
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	mux.HandleFunc("/directory", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"newNonce":   server.URL + "/new-nonce",
+			"newAccount": server.URL + "/new-account",
+			"newOrder":   server.URL + "/new-order",
+			"revokeCert": server.URL + "/revoke-cert",
+			"keyChange":  server.URL + "/key-change",
+		})
+	})
+	mux.HandleFunc("/new-nonce", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+	})
+	mux.HandleFunc("/challenge/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+		domain := strings.TrimPrefix(r.URL.Path, "/challenge/")
+		for _, name := range rejected {
+			if name == domain {
+				w.Header().Set("Content-Type", "application/problem+json")
+				w.WriteHeader(http.StatusForbidden)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"type":   "urn:ietf:params:acme:error:unauthorized",
+					"detail": "challenge rejected",
+				})
+				return
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"type":   "dns-01",
+			"url":    server.URL + r.URL.Path,
+			"status": "valid",
+		})
+	})
+	mux.HandleFunc("/authz/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":     "valid",
+			"identifier": map[string]string{"type": "dns", "value": strings.TrimPrefix(r.URL.Path, "/authz/")},
+		})
+	})
+	return server
+}
+
+func newTestAccount(server *httptest.Server) *Account {
+	a := New(nil, nil, nil)
+	a.DirectoryURL = server.URL + "/directory"
+	a.Registration.Key = privatekey.New()
+	a.Registration.URI = server.URL + "/account/1"
+	a.newClient()
+	return a
+}
+
+// authorization returns a pending authorization for domain with a dns-01
+// challenge
+func authorization(server *httptest.Server, domain string) *acme.Authorization {
+	return &acme.Authorization{
+		URI:        server.URL + "/authz/" + domain,
+		Status:     acme.StatusPending,
+		Identifier: acme.AuthzID{Type: "dns", Value: domain},
+		Challenges: []*acme.Challenge{{
+			Type:  "dns-01",
+			URI:   server.URL + "/challenge/" + domain,
+			Token: "token-" + domain,
+		}},
+	}
+}
+
+func TestFulfilBatch(t *testing.T) {
+	server := newACMEServer(t)
+	a := newTestAccount(server)
+	p := &batchProvider{}
+
+	authzs := []*acme.Authorization{authorization(server, "example.org"), authorization(server, "www.example.org")}
+	if err := a.fulfilBatch(context.Background(), authzs, p); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(p.created) != 2 || p.created[0].Path != "_acme-challenge.example.org." || p.created[1].Path != "_acme-challenge.www.example.org." {
+		t.Errorf("unexpected challenge records %v", p.created)
+	}
+	if fmt.Sprint(p.removed) != fmt.Sprint(p.created) {
+		t.Errorf("expected removed challenge records %v, got %v", p.created, p.removed)
+	}
+}
+
+func TestFulfilBatchRemovesRecordsAfterFailure(t *testing.T) {
+	server := newACMEServer(t, "www.example.org")
+	a := newTestAccount(server)
+
+	authzs := []*acme.Authorization{authorization(server, "example.org"), authorization(server, "www.example.org")}
+
+	// a failed Accept
+	p := &batchProvider{}
+	err := a.fulfilBatch(context.Background(), authzs, p)
+	if err == nil || !strings.HasPrefix(err.Error(), "authorization for www.example.org failed") {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(p.created) != 2 || fmt.Sprint(p.removed) != fmt.Sprint(p.created) {
+		t.Errorf("expected removed challenge records %v, got %v", p.created, p.removed)
+	}
+
+	// a failed propagation
+	p = &batchProvider{waitErr: fmt.Errorf("timeout")}
+	if err := a.fulfilBatch(context.Background(), authzs[:1], p); err == nil {
+		t.Fatal("failed propagation didn't fail")
+	}
+	if len(p.created) != 1 || fmt.Sprint(p.removed) != fmt.Sprint(p.created) {
+		t.Errorf("expected removed challenge records %v, got %v", p.created, p.removed)
+	}
+}
@@ -22,6 +22,7 @@ import (
 
 	"golang.org/x/crypto/acme"
 
+	"github.com/lscheidler/letsencrypt-lambda/account/certificate"
 	"github.com/lscheidler/letsencrypt-lambda/crypto"
 	"github.com/lscheidler/letsencrypt-lambda/helper"
 	"github.com/lscheidler/letsencrypt-lambda/secrets"
@@ -34,13 +35,14 @@ func (ac *AccountCrypt) UnmarshalJSON(b []byte) error {
 	var plaintext []byte
 	var err error
 
-	clientPassphrase := ac.getClientPassphrase()
-
 	if err = json.Unmarshal(b, &jsonData); err != nil {
 		return err
 	}
 
-	if plaintext, err = crypto.Decrypt(jsonData, []byte(*clientPassphrase)); err != nil {
+	(*Account)(ac).bindRegistration()
+
+	var stale bool
+	if plaintext, stale, err = (*Account)(ac).decrypt(jsonData, (*Account)(ac).encryptionContext("account", "")); err != nil {
 		return err
 	}
 
@@ -48,35 +50,143 @@ func (ac *AccountCrypt) UnmarshalJSON(b []byte) error {
 	if err := json.Unmarshal(plaintext, &a); err != nil {
 		return err
 	}
-	*ac = AccountCrypt(a)
+	if stale || (a.Registration != nil && a.Registration.Stale) {
+		a.Changed = true
+	}
 
-	if ac.Registration.Key != nil {
-		ac.client = &acme.Client{
-			Key:          ac.Registration.Key.Signer(),
-			DirectoryURL: DirectoryURL,
-		}
+	if err := a.initClient(); err != nil {
+		return err
 	}
+	*ac = AccountCrypt(a)
 	return nil
 }
 
 func (ac *AccountCrypt) MarshalJSON() ([]byte, error) {
 	var ciphertext []byte
 
-	clientPassphrase := ac.getClientPassphrase()
-
 	a := Account(*ac)
+	a.bindRegistration()
 	plaintext, err := json.Marshal(&a)
 	if err != nil {
 		return nil, err
 	}
 
-	if ciphertext, err = crypto.Encrypt(plaintext, []byte(*clientPassphrase)); err != nil {
+	if ciphertext, err = a.encrypt(plaintext, a.encryptionContext("account", "")); err != nil {
 		return nil, err
 	}
 
 	return json.Marshal(ciphertext)
 }
 
+// MarshalRegistration returns the registration encrypted with the issuer
+// passphrase
+func (a *Account) MarshalRegistration() ([]byte, error) {
+	a.bindRegistration()
+	return json.Marshal(a.Registration)
+}
+
+// UnmarshalRegistration decrypts the registration b and initializes the
+// acme.Client
+func (a *Account) UnmarshalRegistration(b []byte) error {
+	a.bindRegistration()
+	if err := json.Unmarshal(b, a.Registration); err != nil {
+		return err
+	}
+	if a.Registration.Stale {
+		a.Changed = true
+	}
+	return a.initClient()
+}
+
+// MarshalCertificate returns the certificate name encrypted with the client
+// passphrase or KMS
+func (a *Account) MarshalCertificate(name string) ([]byte, error) {
+	var ciphertext []byte
+
+	plaintext, err := json.Marshal(a.Certificates[name])
+	if err != nil {
+		return nil, err
+	}
+
+	if ciphertext, err = a.encrypt(plaintext, a.encryptionContext("certificate", name)); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(ciphertext)
+}
+
+// UnmarshalCertificate decrypts the certificate b and adds it as name. stale
+// is true, if the certificate should be encrypted again (e.g. after a
+// passphrase rotation).
+func (a *Account) UnmarshalCertificate(name string, b []byte) (stale bool, err error) {
+	var jsonData []byte
+	var plaintext []byte
+
+	if err = json.Unmarshal(b, &jsonData); err != nil {
+		return false, err
+	}
+
+	if plaintext, stale, err = a.decrypt(jsonData, a.encryptionContext("certificate", name)); err != nil {
+		return false, err
+	}
+
+	var cert certificate.Certificate
+	if err := json.Unmarshal(plaintext, &cert); err != nil {
+		return false, err
+	}
+	a.Certificates[name] = &cert
+	if stale {
+		a.Changed = true
+	}
+	return stale, nil
+}
+
+// encrypt encrypts plaintext with KMS, if it is enabled, otherwise with the
+// client passphrase. The ciphertext is bound to context.
+func (a *Account) encrypt(plaintext []byte, context map[string]string) ([]byte, error) {
+	return crypto.Seal(plaintext, a.getClientPassphrase, context)
+}
+
+// decrypt decrypts ciphertext encrypted by encrypt with the same context, with
+// the previous client passphrase as fallback
+func (a *Account) decrypt(ciphertext []byte, context map[string]string) ([]byte, bool, error) {
+	return crypto.Open(ciphertext, a.getClientPassphrase, a.getPreviousClientPassphrase, context)
+}
+
+// encryptionContext returns the context, the encrypted item of type
+// itemType (account, certificate) is bound to. name is the certificate name.
+func (a *Account) encryptionContext(itemType string, name string) map[string]string {
+	context := map[string]string{
+		"purpose": "client",
+		"type":    itemType,
+		"email":   *a.Email,
+	}
+	if name != "" {
+		context["name"] = name
+	}
+	return context
+}
+
+// bindRegistration binds the encrypted registration to the email
+func (a *Account) bindRegistration() {
+	if a.Registration != nil {
+		a.Registration.Email = *a.Email
+	}
+}
+
+// initClient initializes the acme.Client, if the registration key is
+// available (not in client mode)
+func (a *Account) initClient() error {
+	if a.Registration.Key == nil {
+		return nil
+	}
+	if err := a.checkDirectory(); err != nil {
+		return err
+	}
+	a.newClient()
+	return nil
+}
+
 // https://github.com/golang/crypto/blob/5c72a883971a4325f8c62bf07b6d38c20ea47a6a/acme/autocert/autocert.go#L831
 func pickChallenge(typ string, chal []*acme.Challenge) *acme.Challenge {
 	for _, c := range chal {
@@ -87,9 +197,9 @@ func pickChallenge(typ string, chal []*acme.Challenge) *acme.Challenge {
 	return nil
 }
 
-func (ac *AccountCrypt) getClientPassphrase() *string {
-	if ac.ClientPassphrase != nil {
-		return ac.ClientPassphrase
+func (a *Account) getClientPassphrase() *string {
+	if a.ClientPassphrase != nil {
+		return a.ClientPassphrase
 	} else if clientPassphrase := helper.Getenv("CLIENT_PASSPHRASE"); clientPassphrase == nil {
 		if clientPassphraseSecretsArn := helper.Getenv("CLIENT_PASSPHRASE_SECRET_ARN"); clientPassphraseSecretsArn == nil {
 			log.Fatal("Environment variable CLIENT_PASSPHRASE and CLIENT_PASSPHRASE_SECRET_ARN not found. One of these environment variables must be set.")
@@ -106,3 +216,17 @@ func (ac *AccountCrypt) getClientPassphrase() *string {
 		return clientPassphrase
 	}
 }
+
+// getPreviousClientPassphrase returns the client passphrase before the last
+// rotation from CLIENT_PASSPHRASE_PREVIOUS or the version stage AWSPREVIOUS
+// of CLIENT_PASSPHRASE_SECRET_ARN
+func (a *Account) getPreviousClientPassphrase() *string {
+	if a.ClientPassphrase != nil {
+		return nil
+	} else if clientPassphrase := helper.Getenv("CLIENT_PASSPHRASE_PREVIOUS"); clientPassphrase != nil {
+		return clientPassphrase
+	} else if clientPassphraseSecretsArn := helper.Getenv("CLIENT_PASSPHRASE_SECRET_ARN"); clientPassphraseSecretsArn != nil {
+		return secrets.GetPreviousSecret(clientPassphraseSecretsArn)
+	}
+	return nil
+}
@@ -20,17 +20,77 @@ import (
 	"bytes"
 	"crypto/ecdsa"
 	"crypto/rand"
+	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/lscheidler/letsencrypt-lambda/account/certificate/privatekey"
 	"github.com/lscheidler/letsencrypt-lambda/crypto"
 )
 
+// Config describes a certificate, which should be issued and renewed
+type Config struct {
+	Name    string   `json:"name"`
+	Domains []string `json:"domains"`
+	// KeyType of the private key (RSA-2048, RSA-4096, P-256, P-384), default
+	// is P-256
+	KeyType privatekey.KeyType `json:"keyType,omitempty"`
+	// RenewBefore is the remaining lifetime, when the certificate is renewed
+	// (e.g. 720h, 30d), default is DefaultRenewBefore
+	RenewBefore Duration `json:"renewBefore,omitempty"`
+	// RenewBeforeRatio is the fraction of the lifetime, which must remain
+	// before renewal (e.g. 0.33). It takes precedence over RenewBefore.
+	RenewBeforeRatio float64 `json:"renewBeforeRatio,omitempty"`
+	// DisableARI disables ACME Renewal Information. Otherwise the renewal
+	// window suggested by the CA is used, if the CA supports ARI.
+	DisableARI bool `json:"disableARI,omitempty"`
+	// KeyPolicy defines, when the private key is replaced on renewal
+	// (reuse, rotate, max-age), default is reuse
+	KeyPolicy KeyPolicy `json:"keyPolicy,omitempty"`
+	// KeyMaxAge is the maximum age of the private key with key policy max-age
+	KeyMaxAge Duration `json:"keyMaxAge,omitempty"`
+	// ACMExport imports the certificate into AWS Certificate Manager
+	ACMExport bool `json:"acmExport,omitempty"`
+	// ACMRegion is the region of AWS Certificate Manager (e.g. us-east-1 for
+	// CloudFront), default is the region of the lambda function
+	ACMRegion string `json:"acmRegion,omitempty"`
+	// DNSProvider fulfils the dns-01 challenges (route53, cloudflare,
+	// rfc2136), default is the provider of the account
+	DNSProvider string `json:"dnsProvider,omitempty"`
+}
+
+// Exporter exports issued certificates to other services
+type Exporter interface {
+	Export(config *Config, cert *Certificate) error
+}
+
+type KeyPolicy string
+
+const (
+	// KeyPolicyReuse reuses the private key for every renewal
+	KeyPolicyReuse KeyPolicy = "reuse"
+	// KeyPolicyRotate creates a new private key for every renewal
+	KeyPolicyRotate KeyPolicy = "rotate"
+	// KeyPolicyMaxAge creates a new private key on renewal, if the private
+	// key is older than KeyMaxAge
+	KeyPolicyMaxAge KeyPolicy = "max-age"
+
+	// MaxKeyHistory is the number of retired private keys kept per certificate
+	MaxKeyHistory = 10
+)
+
+// HistoricKey is a retired private key of a certificate
+type HistoricKey struct {
+	Key       *privatekey.PrivateKey `json:"privateKey"`
+	CreatedAt time.Time              `json:"createdAt"`
+	RetiredAt time.Time              `json:"retiredAt"`
+}
+
 type Certificate struct {
 	Domains       []string `json:"domains"`
 	CertUrl       *string  `json:"certUrl"`
@@ -42,22 +102,58 @@ type Certificate struct {
 
 	KeyCreatedAt time.Time              `json:"privateKeyCreatedAt"`
 	Key          *privatekey.PrivateKey `json:"privateKey"`
+	KeyHistory   []HistoricKey          `json:"privateKeyHistory,omitempty"`
+
+	Revocations []Revocation `json:"revocations,omitempty"`
+
+	ACMCertificateArn *string    `json:"acmCertificateArn,omitempty"`
+	ACMImportedAt     *time.Time `json:"acmImportedAt,omitempty"`
 }
 
-func New(domains []string) *Certificate {
+func New(domains []string, keyType privatekey.KeyType) (*Certificate, error) {
+	key, err := privatekey.NewWithType(keyType)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Certificate{
 		Domains:      domains,
-		Key:          privatekey.New(),
+		Key:          key,
 		KeyCreatedAt: time.Now(),
+	}, nil
+}
+
+// Matches returns true, if the certificate was issued for the domains and
+// with the key type of config
+func (c *Certificate) Matches(config *Config) bool {
+	if c.Key.Type != config.KeyType {
+		return false
+	}
+	if len(c.Domains) != len(config.Domains) {
+		return false
+	}
+	for index := range c.Domains {
+		if c.Domains[index] != config.Domains[index] {
+			return false
+		}
 	}
+	return true
 }
 
-func (c *Certificate) Add(data [][]byte) error {
-	c.CreatedAt = time.Now()
-	leaf, err := c.ValidCert(data, c.CreatedAt)
+// Add adds the issued certificate chain data, which was requested with key.
+// If key isn't the current private key, the current key is retired.
+func (c *Certificate) Add(data [][]byte, key *privatekey.PrivateKey) error {
+	now := time.Now()
+	leaf, err := c.ValidCert(data, key, now)
 	if err != nil {
 		return err
 	}
+	if key != c.Key {
+		c.retireKey(now)
+		c.Key = key
+		c.KeyCreatedAt = now
+	}
+	c.CreatedAt = now
 	tlsCertificate := c.tlscert(data, leaf)
 	c.NotAfter = leaf.NotAfter
 
@@ -68,24 +164,103 @@ func (c *Certificate) Add(data [][]byte) error {
 	return nil
 }
 
+// PemParts returns the pem encoded leaf certificate, the certificate chain
+// and the private key
+func (c *Certificate) PemParts() (leaf []byte, chain []byte, key []byte, err error) {
+	rest := c.Pem
+	for {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+
+		encoded := pem.EncodeToMemory(block)
+		switch {
+		case block.Type != "CERTIFICATE":
+			key = encoded
+		case leaf == nil:
+			leaf = encoded
+		default:
+			chain = append(chain, encoded...)
+		}
+	}
+
+	if leaf == nil || key == nil {
+		return nil, nil, nil, errors.New("certificate or private key not found")
+	}
+	return leaf, chain, key, nil
+}
+
+// Leaf returns the parsed leaf certificate
+func (c *Certificate) Leaf() (*x509.Certificate, error) {
+	rest := c.Pem
+	for {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			return nil, errors.New("no certificate found")
+		}
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+}
+
+// NewKey returns a new private key of the same type as the current private
+// key. The current key is replaced, when a certificate for the new key is
+// added.
+func (c *Certificate) NewKey() (*privatekey.PrivateKey, error) {
+	return privatekey.NewWithType(c.Key.Type)
+}
+
+// KeyRotationDue returns true, if the private key should be replaced on
+// renewal according to the key policy of config
+func (c *Certificate) KeyRotationDue(config *Config) bool {
+	switch config.KeyPolicy {
+	case KeyPolicyRotate:
+		return true
+	case KeyPolicyMaxAge:
+		return time.Since(c.KeyCreatedAt) >= time.Duration(config.KeyMaxAge)
+	default:
+		return false
+	}
+}
+
+// retireKey moves the current private key to the key history. The history is
+// limited to MaxKeyHistory keys.
+func (c *Certificate) retireKey(now time.Time) {
+	c.KeyHistory = append(c.KeyHistory, HistoricKey{
+		Key:       c.Key,
+		CreatedAt: c.KeyCreatedAt,
+		RetiredAt: now,
+	})
+	if len(c.KeyHistory) > MaxKeyHistory {
+		c.KeyHistory = c.KeyHistory[len(c.KeyHistory)-MaxKeyHistory:]
+	}
+}
+
+// serial returns the hex encoded serial number of cert
+func serial(cert *x509.Certificate) string {
+	return fmt.Sprintf("%x", cert.SerialNumber)
+}
+
 // certRequest generates a CSR for the given common name cn and optional SANs.
 // see: https://github.com/golang/crypto/blob/5c72a883971a4325f8c62bf07b6d38c20ea47a6a/acme/autocert/autocert.go#L1137
-func (c *Certificate) Request() ([]byte, error) {
+func (c *Certificate) Request(key *privatekey.PrivateKey) ([]byte, error) {
 	req := &x509.CertificateRequest{
 		Subject:         pkix.Name{CommonName: c.Domains[0]}, // cn
 		DNSNames:        c.Domains[1:len(c.Domains)],         // san
 		ExtraExtensions: []pkix.Extension{},
 	}
-	return x509.CreateCertificateRequest(rand.Reader, req, c.Key.Signer())
+	return x509.CreateCertificateRequest(rand.Reader, req, key.Signer())
 }
 
 // validCert parses a cert chain provided as der argument and verifies the leaf and der[0]
-// correspond to the private key, the domain and key type match, and expiration dates
+// correspond to the private key key, the domain and key type match, and expiration dates
 // are valid. It doesn't do any revocation checking.
 //
 // The returned value is the verified leaf cert.
 // see: https://github.com/golang/crypto/blob/5c72a883971a4325f8c62bf07b6d38c20ea47a6a/acme/autocert/autocert.go#L1177
-func (c *Certificate) ValidCert(der [][]byte, now time.Time) (leaf *x509.Certificate, err error) {
+func (c *Certificate) ValidCert(der [][]byte, key *privatekey.PrivateKey, now time.Time) (leaf *x509.Certificate, err error) {
 	// parse public part(s)
 	var n int
 	for _, b := range der {
@@ -113,8 +288,19 @@ func (c *Certificate) ValidCert(der [][]byte, now time.Time) (leaf *x509.Certifi
 	}
 	// ensure the leaf corresponds to the private key and matches the certKey type
 	switch pub := leaf.PublicKey.(type) {
+	case *rsa.PublicKey:
+		prv, ok := key.Signer().(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("private key type does not match public key type")
+		}
+		if pub.N.Cmp(prv.N) != 0 {
+			return nil, errors.New("private key does not match public key")
+		}
 	case *ecdsa.PublicKey:
-		prv := ecdsa.PrivateKey(*c.Key)
+		prv, ok := key.Signer().(*ecdsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("private key type does not match public key type")
+		}
 		if pub.X.Cmp(prv.X) != 0 || pub.Y.Cmp(prv.Y) != 0 {
 			return nil, errors.New("private key does not match public key")
 		}
@@ -134,7 +320,18 @@ func (c *Certificate) tlscert(cert [][]byte, leaf *x509.Certificate) *tls.Certif
 
 func generatePem(tlscert *tls.Certificate) ([]byte, error) {
 	var buf bytes.Buffer
-	crypto.EncodeECDSAKey(&buf, tlscert.PrivateKey.(*ecdsa.PrivateKey))
+	switch key := tlscert.PrivateKey.(type) {
+	case *rsa.PrivateKey:
+		if err := crypto.EncodeRSAKey(&buf, key); err != nil {
+			return nil, err
+		}
+	case *ecdsa.PrivateKey:
+		if err := crypto.EncodeECDSAKey(&buf, key); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("unknown private key algorithm")
+	}
 
 	// public
 	// see: https://github.com/golang/crypto/blob/5c72a883971a4325f8c62bf07b6d38c20ea47a6a/acme/autocert/autocert.go#L536
@@ -21,49 +21,132 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/rsa"
 	"crypto/x509"
 	"encoding/json"
+	"fmt"
 	"log"
+	"strings"
 )
 
-type PrivateKey ecdsa.PrivateKey
+type KeyType string
 
+const (
+	RSA2048 KeyType = "RSA-2048"
+	RSA4096 KeyType = "RSA-4096"
+	P256    KeyType = "P-256"
+	P384    KeyType = "P-384"
+
+	DefaultKeyType = P256
+)
+
+// PrivateKey is a private key of a supported KeyType
+type PrivateKey struct {
+	Type   KeyType
+	signer crypto.Signer
+}
+
+// privateKeyJSON is the serialization of PrivateKey. Previous versions
+// serialized only the DER encoded P-256 key, without type.
+type privateKeyJSON struct {
+	Type KeyType `json:"type"`
+	Key  []byte  `json:"key"`
+}
+
+// New returns a new P-256 private key
 func New() *PrivateKey {
-	privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	privateKey, err := NewWithType(DefaultKeyType)
 	if err != nil {
 		log.Fatal(err)
 	}
-	privateKey := PrivateKey(*privKey)
-	return &privateKey
+	return privateKey
+}
+
+// NewWithType returns a new private key of keyType
+func NewWithType(keyType KeyType) (*PrivateKey, error) {
+	var signer crypto.Signer
+	var err error
+
+	switch keyType {
+	case RSA2048:
+		signer, err = rsa.GenerateKey(rand.Reader, 2048)
+	case RSA4096:
+		signer, err = rsa.GenerateKey(rand.Reader, 4096)
+	case P256:
+		signer, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case P384:
+		signer, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	default:
+		return nil, fmt.Errorf("unsupported key type %s", keyType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &PrivateKey{Type: keyType, signer: signer}, nil
+}
+
+// ParseKeyType parses a key type (e.g. RSA-2048, P-256). An empty key type is
+// the DefaultKeyType.
+func ParseKeyType(keyType string) (KeyType, error) {
+	if keyType == "" {
+		return DefaultKeyType, nil
+	}
+	for _, k := range []KeyType{RSA2048, RSA4096, P256, P384} {
+		if strings.EqualFold(string(k), keyType) {
+			return k, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported key type %s", keyType)
 }
 
 func (p *PrivateKey) UnmarshalJSON(b []byte) error {
-	var j []byte
-	if err := json.Unmarshal(b, &j); err != nil {
-		return err
-	} else {
-		var ep *ecdsa.PrivateKey
-		if ep, err = x509.ParseECPrivateKey(j); err != nil {
+	var j privateKeyJSON
+	if len(b) > 0 && b[0] == '"' {
+		// legacy format
+		if err := json.Unmarshal(b, &j.Key); err != nil {
 			return err
-		} else {
-			*p = PrivateKey(*ep)
 		}
+		ep, err := x509.ParseECPrivateKey(j.Key)
+		if err != nil {
+			return err
+		}
+		p.signer = ep
+		p.Type = curveKeyType(ep.Curve)
+		return nil
 	}
 
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(j.Key)
+	if err != nil {
+		return err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return fmt.Errorf("unsupported private key")
+	}
+	p.Type = j.Type
+	p.signer = signer
 	return nil
 }
 
 func (p *PrivateKey) MarshalJSON() ([]byte, error) {
-	ep := ecdsa.PrivateKey(*p)
-	b, err := x509.MarshalECPrivateKey(&ep)
+	b, err := x509.MarshalPKCS8PrivateKey(p.signer)
 	if err != nil {
 		return nil, err
 	}
 
-	return json.Marshal(b)
+	return json.Marshal(&privateKeyJSON{Type: p.Type, Key: b})
 }
 
 func (p *PrivateKey) Signer() crypto.Signer {
-	ep := ecdsa.PrivateKey(*p)
-	return crypto.Signer(&ep)
+	return p.signer
+}
+
+func curveKeyType(curve elliptic.Curve) KeyType {
+	if curve == elliptic.P384() {
+		return P384
+	}
+	return P256
 }
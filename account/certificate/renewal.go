@@ -0,0 +1,180 @@
+/*
+Copyright 2020 Lars Eric Scheidler
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package certificate
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultRenewBefore is used, if neither RenewBefore nor RenewBeforeRatio
+	// is configured
+	DefaultRenewBefore = 30 * 24 * time.Hour
+)
+
+// Duration is a time.Duration, which is (un)marshaled as string (e.g. 720h).
+// Additionally days (e.g. 30d) are supported.
+type Duration time.Duration
+
+// ParseDuration parses a duration string like time.ParseDuration with
+// additional support for days (e.g. 30d)
+func ParseDuration(s string) (Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.ParseFloat(strings.TrimSuffix(s, "d"), 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %s", s)
+		}
+		return Duration(days * float64(24*time.Hour)), nil
+	}
+
+	d, err := time.ParseDuration(s)
+	return Duration(d), err
+}
+
+// UnmarshalJSON parses a duration string, null and an empty string leave the
+// duration unset
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		return nil
+	}
+
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	if s == "" {
+		*d = 0
+		return nil
+	}
+
+	var err error
+	*d, err = ParseDuration(s)
+	return err
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// RenewalInfo is the ACME Renewal Information (RFC 9773) of a certificate
+type RenewalInfo struct {
+	SuggestedWindow struct {
+		Start time.Time `json:"start"`
+		End   time.Time `json:"end"`
+	} `json:"suggestedWindow"`
+	ExplanationURL string `json:"explanationURL,omitempty"`
+}
+
+// RenewalTime returns the time, when the certificate should be renewed
+// according to RenewBeforeRatio or RenewBefore of config
+func (c *Certificate) RenewalTime(config *Config) time.Time {
+	if config.RenewBeforeRatio > 0 {
+		if leaf, err := c.Leaf(); err == nil {
+			lifetime := leaf.NotAfter.Sub(leaf.NotBefore)
+			return leaf.NotAfter.Add(-time.Duration(float64(lifetime) * config.RenewBeforeRatio))
+		}
+	}
+
+	renewBefore := DefaultRenewBefore
+	if config.RenewBefore > 0 {
+		renewBefore = time.Duration(config.RenewBefore)
+	}
+	return c.NotAfter.Add(-renewBefore)
+}
+
+// RenewalInfo fetches the renewal information of the certificate from
+// renewalInfoURL, the renewalInfo resource of the acme directory
+func (c *Certificate) RenewalInfo(ctx context.Context, httpClient *http.Client, renewalInfoURL string) (*RenewalInfo, error) {
+	leaf, err := c.Leaf()
+	if err != nil {
+		return nil, err
+	}
+
+	certID, err := renewalInfoCertID(leaf)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("GET", strings.TrimSuffix(renewalInfoURL, "/")+"/"+certID, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	res, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("renewal info request failed: %s", res.Status)
+	}
+
+	var info RenewalInfo
+	if err := json.NewDecoder(res.Body).Decode(&info); err != nil {
+		return nil, err
+	}
+	if info.SuggestedWindow.End.Before(info.SuggestedWindow.Start) {
+		return nil, errors.New("invalid suggested window")
+	}
+	return &info, nil
+}
+
+// SelectTime returns a uniform random time within the suggested window
+func (r *RenewalInfo) SelectTime() time.Time {
+	window := r.SuggestedWindow.End.Sub(r.SuggestedWindow.Start)
+	if window <= 0 {
+		return r.SuggestedWindow.Start
+	}
+	offset, err := rand.Int(rand.Reader, big.NewInt(int64(window)))
+	if err != nil {
+		return r.SuggestedWindow.Start
+	}
+	return r.SuggestedWindow.Start.Add(time.Duration(offset.Int64()))
+}
+
+// renewalInfoCertID returns the unique identifier of the certificate
+// (base64url(authority key identifier) "." base64url(serial number))
+// see: RFC 9773 section 4.1
+func renewalInfoCertID(leaf *x509.Certificate) (string, error) {
+	if len(leaf.AuthorityKeyId) == 0 {
+		return "", errors.New("certificate has no authority key identifier")
+	}
+
+	// DER encoding of the serial number without tag and length, a leading
+	// zero byte is required, if the most significant bit is set
+	serial := leaf.SerialNumber.Bytes()
+	if len(serial) == 0 || serial[0]&0x80 != 0 {
+		serial = append([]byte{0}, serial...)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(leaf.AuthorityKeyId) + "." + base64.RawURLEncoding.EncodeToString(serial), nil
+}
@@ -0,0 +1,205 @@
+/*
+Copyright 2020 Lars Eric Scheidler
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package certificate
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDurationUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected Duration
+	}{
+		{`null`, 0},
+		{`""`, 0},
+		{`"720h"`, Duration(720 * time.Hour)},
+		{`"30d"`, Duration(30 * 24 * time.Hour)},
+	}
+
+	for _, test := range tests {
+		var d Duration
+		if err := json.Unmarshal([]byte(test.input), &d); err != nil {
+			t.Errorf("unmarshal %s failed: %v", test.input, err)
+		} else if d != test.expected {
+			t.Errorf("unmarshal %s: expected %v, got %v", test.input, time.Duration(test.expected), time.Duration(d))
+		}
+	}
+
+	var d Duration
+	if err := json.Unmarshal([]byte(`"30x"`), &d); err == nil {
+		t.Error("unmarshal of invalid duration succeeded")
+	}
+}
+
+func TestConfigUnmarshalJSONWithNull(t *testing.T) {
+	// payload as written by terraform jsonencode for unset optional values
+	payload := `[{"name":"example.org","domains":["example.org"],"keyType":"","renewBefore":null,"renewBeforeRatio":null,"disableARI":false}]`
+
+	var configs []Config
+	if err := json.Unmarshal([]byte(payload), &configs); err != nil {
+		t.Fatal(err)
+	}
+	if configs[0].RenewBefore != 0 {
+		t.Errorf("expected unset renewBefore, got %v", time.Duration(configs[0].RenewBefore))
+	}
+}
+
+func TestRenewalInfoCertID(t *testing.T) {
+	// example of RFC 9773 section 4.1, the serial number has the most
+	// significant bit set and requires a leading zero byte
+	aki, _ := hex.DecodeString("69885b6b87464041e1b37b847ba0ae2cde01c8d4")
+	serial, _ := new(big.Int).SetString("87654321", 16)
+
+	certID, err := renewalInfoCertID(&x509.Certificate{AuthorityKeyId: aki, SerialNumber: serial})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if certID != "aYhba4dGQEHhs3uEe6CuLN4ByNQ.AIdlQyE" {
+		t.Errorf("unexpected cert id %s", certID)
+	}
+
+	certID, err = renewalInfoCertID(&x509.Certificate{AuthorityKeyId: aki, SerialNumber: big.NewInt(0x7f01)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(certID, ".fwE") {
+		t.Errorf("unexpected serial in cert id %s", certID)
+	}
+
+	if _, err := renewalInfoCertID(&x509.Certificate{SerialNumber: serial}); err == nil {
+		t.Error("cert id without authority key identifier")
+	}
+}
+
+func TestRenewalTime(t *testing.T) {
+	notBefore := time.Now().Add(-time.Hour).Truncate(time.Second)
+	notAfter := notBefore.Add(90 * 24 * time.Hour)
+	cert := newCertificate(t, notBefore, notAfter)
+
+	tests := []struct {
+		config   Config
+		expected time.Time
+	}{
+		{Config{}, notAfter.Add(-DefaultRenewBefore)},
+		{Config{RenewBefore: Duration(10 * 24 * time.Hour)}, notAfter.Add(-10 * 24 * time.Hour)},
+		{Config{RenewBeforeRatio: 0.5}, notAfter.Add(-45 * 24 * time.Hour)},
+		// the ratio takes precedence
+		{Config{RenewBefore: Duration(10 * 24 * time.Hour), RenewBeforeRatio: 0.5}, notAfter.Add(-45 * 24 * time.Hour)},
+	}
+
+	for _, test := range tests {
+		if renewalTime := cert.RenewalTime(&test.config); !renewalTime.Equal(test.expected) {
+			t.Errorf("%+v: expected %v, got %v", test.config, test.expected, renewalTime)
+		}
+	}
+}
+
+func TestSelectTime(t *testing.T) {
+	var info RenewalInfo
+	info.SuggestedWindow.Start = time.Now()
+	info.SuggestedWindow.End = info.SuggestedWindow.Start.Add(time.Hour)
+
+	for i := 0; i < 100; i++ {
+		selected := info.SelectTime()
+		if selected.Before(info.SuggestedWindow.Start) || selected.After(info.SuggestedWindow.End) {
+			t.Fatalf("%v is outside of the suggested window", selected)
+		}
+	}
+
+	info.SuggestedWindow.End = info.SuggestedWindow.Start
+	if selected := info.SelectTime(); !selected.Equal(info.SuggestedWindow.Start) {
+		t.Errorf("expected start of empty window, got %v", selected)
+	}
+}
+
+func TestRenewalInfo(t *testing.T) {
+	cert := newCertificate(t, time.Now().Add(-time.Hour), time.Now().Add(90*24*time.Hour))
+	leaf, err := cert.Leaf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	certID, err := renewalInfoCertID(leaf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now().Add(24 * time.Hour).UTC().Truncate(time.Second)
+	end := start.Add(2 * time.Hour)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/renewal-info/" + certID:
+			fmt.Fprintf(w, `{"suggestedWindow":{"start":%q,"end":%q}}`, start.Format(time.RFC3339), end.Format(time.RFC3339))
+		case "/inverted/" + certID:
+			fmt.Fprintf(w, `{"suggestedWindow":{"start":%q,"end":%q}}`, end.Format(time.RFC3339), start.Format(time.RFC3339))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	info, err := cert.RenewalInfo(context.Background(), server.Client(), server.URL+"/renewal-info/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.SuggestedWindow.Start.Equal(start) || !info.SuggestedWindow.End.Equal(end) {
+		t.Errorf("unexpected window %v - %v", info.SuggestedWindow.Start, info.SuggestedWindow.End)
+	}
+
+	if _, err := cert.RenewalInfo(context.Background(), server.Client(), server.URL+"/inverted"); err == nil || err.Error() != "invalid suggested window" {
+		t.Errorf("expected invalid suggested window, got %v", err)
+	}
+}
+
+// newCertificate returns a certificate with a self-signed leaf, which has an
+// authority key identifier
+func newCertificate(t *testing.T, notBefore, notAfter time.Time) *Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		AuthorityKeyId: []byte{1, 2, 3, 4},
+		SerialNumber:   big.NewInt(0x8001),
+		Subject:        pkix.Name{CommonName: "example.org"},
+		NotBefore:      notBefore,
+		NotAfter:       notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Certificate{
+		NotAfter: notAfter,
+		Pem:      pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
@@ -0,0 +1,111 @@
+/*
+Copyright 2020 Lars Eric Scheidler
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package certificate
+
+import (
+	"context"
+	"crypto"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// Revocation records the revocation of a certificate
+type Revocation struct {
+	Serial    string             `json:"serial"`
+	RevokedAt time.Time          `json:"revokedAt"`
+	Reason    acme.CRLReasonCode `json:"reason"`
+}
+
+// reasonCodes are the RFC 5280 reason codes, which can be used for revocation
+var reasonCodes = map[string]acme.CRLReasonCode{
+	"unspecified":          acme.CRLReasonUnspecified,
+	"keycompromise":        acme.CRLReasonKeyCompromise,
+	"cacompromise":         acme.CRLReasonCACompromise,
+	"affiliationchanged":   acme.CRLReasonAffiliationChanged,
+	"superseded":           acme.CRLReasonSuperseded,
+	"cessationofoperation": acme.CRLReasonCessationOfOperation,
+	"certificatehold":      acme.CRLReasonCertificateHold,
+	"removefromcrl":        acme.CRLReasonRemoveFromCRL,
+	"privilegewithdrawn":   acme.CRLReasonPrivilegeWithdrawn,
+	"aacompromise":         acme.CRLReasonAACompromise,
+}
+
+// ParseReasonCode parses a RFC 5280 reason code by name (e.g. keyCompromise)
+// or by number. An empty reason is unspecified.
+func ParseReasonCode(reason string) (acme.CRLReasonCode, error) {
+	if reason == "" {
+		return acme.CRLReasonUnspecified, nil
+	}
+	if code, ok := reasonCodes[strings.ToLower(reason)]; ok {
+		return code, nil
+	}
+	if code, err := strconv.Atoi(reason); err == nil {
+		for _, c := range reasonCodes {
+			if int(c) == code {
+				return c, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("unknown revocation reason %s", reason)
+}
+
+// Revoke revokes the certificate with reason. The revocation request is signed
+// with the account key of client or with the certificate key, if
+// signWithCertificateKey is true.
+func (c *Certificate) Revoke(ctx context.Context, client *acme.Client, reason acme.CRLReasonCode, signWithCertificateKey bool) error {
+	if c.IsRevoked() {
+		return fmt.Errorf("certificate is already revoked")
+	}
+
+	leaf, err := c.Leaf()
+	if err != nil {
+		return err
+	}
+
+	var key crypto.Signer
+	if signWithCertificateKey {
+		key = c.Key.Signer()
+	}
+
+	if err := client.RevokeCert(ctx, key, leaf.Raw, reason); err != nil {
+		return err
+	}
+
+	c.Revocations = append(c.Revocations, Revocation{
+		Serial:    serial(leaf),
+		RevokedAt: time.Now(),
+		Reason:    reason,
+	})
+	return nil
+}
+
+// IsRevoked returns true, if the current certificate was revoked
+func (c *Certificate) IsRevoked() bool {
+	if len(c.Revocations) == 0 {
+		return false
+	}
+
+	leaf, err := c.Leaf()
+	if err != nil {
+		return false
+	}
+	return c.Revocations[len(c.Revocations)-1].Serial == serial(leaf)
+}
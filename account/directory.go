@@ -0,0 +1,161 @@
+/*
+Copyright 2020 Lars Eric Scheidler
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package account
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+)
+
+const (
+	LetsencryptURL        = "https://acme-v02.api.letsencrypt.org/directory"
+	LetsencryptStagingURL = "https://acme-staging-v02.api.letsencrypt.org/directory"
+	ZeroSSLURL            = "https://acme.zerossl.com/v2/DV90"
+	BuypassURL            = "https://api.buypass.com/acme/directory"
+	BuypassStagingURL     = "https://api.test4.buypass.no/acme/directory"
+
+	// DirectoryURL is the default acme directory
+	DirectoryURL = LetsencryptURL
+)
+
+var directoryAliases = map[string]string{
+	"production":          LetsencryptURL,
+	"staging":             LetsencryptStagingURL,
+	"letsencrypt":         LetsencryptURL,
+	"letsencrypt-staging": LetsencryptStagingURL,
+	"zerossl":             ZeroSSLURL,
+	"buypass":             BuypassURL,
+	"buypass-staging":     BuypassStagingURL,
+}
+
+// ResolveDirectoryURL returns the directory url for an alias (e.g. staging,
+// production, zerossl) or validates the directory url of a RFC 8555 compliant
+// acme server
+func ResolveDirectoryURL(directory string) (string, error) {
+	if directoryURL, ok := directoryAliases[strings.ToLower(directory)]; ok {
+		return directoryURL, nil
+	}
+
+	u, err := url.Parse(directory)
+	if err != nil {
+		return "", err
+	}
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return "", fmt.Errorf("invalid acme directory url: %s", directory)
+	}
+	return directory, nil
+}
+
+// NewHTTPClient returns a http.Client, which trusts the system roots and the
+// certificates of caBundle. caBundle can be a pem encoded bundle or a path to
+// a pem encoded file.
+func NewHTTPClient(caBundle string) (*http.Client, error) {
+	var pemCerts []byte
+	if strings.Contains(caBundle, "-----BEGIN CERTIFICATE-----") {
+		pemCerts = []byte(caBundle)
+	} else {
+		var err error
+		if pemCerts, err = ioutil.ReadFile(caBundle); err != nil {
+			return nil, err
+		}
+	}
+
+	rootCAs, err := x509.SystemCertPool()
+	if err != nil || rootCAs == nil {
+		rootCAs = x509.NewCertPool()
+	}
+	if ok := rootCAs.AppendCertsFromPEM(pemCerts); !ok {
+		return nil, fmt.Errorf("no certificates found in ca bundle")
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: rootCAs}
+	return &http.Client{Transport: transport}, nil
+}
+
+// directoryURL returns the configured acme directory
+func (a *Account) directoryURL() string {
+	if a.DirectoryURL == "" {
+		return DirectoryURL
+	}
+	return a.DirectoryURL
+}
+
+// discoverRenewalInfo returns the renewalInfo resource of the acme directory
+// or an empty string, if the CA doesn't support ACME Renewal Information
+// (RFC 9773)
+func (a *Account) discoverRenewalInfo(ctx context.Context) (string, error) {
+	req, err := http.NewRequest("GET", a.directoryURL(), nil)
+	if err != nil {
+		return "", err
+	}
+
+	httpClient := a.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	res, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("directory request failed: %s", res.Status)
+	}
+
+	var dir struct {
+		RenewalInfo string `json:"renewalInfo"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&dir); err != nil {
+		return "", err
+	}
+	return dir.RenewalInfo, nil
+}
+
+// newClient initializes the acme.Client with the registration key
+func (a *Account) newClient() {
+	a.client = &acme.Client{
+		Key:          a.Registration.Key.Signer(),
+		DirectoryURL: a.directoryURL(),
+		HTTPClient:   a.HTTPClient,
+		KID:          acme.KeyID(a.Registration.URI),
+	}
+}
+
+// checkDirectory ensures, that the registration belongs to the configured
+// acme directory. Registrations without directory url were created by
+// previous versions with the letsencrypt production directory.
+func (a *Account) checkDirectory() error {
+	registered := a.Registration.DirectoryURL
+	if registered == "" {
+		registered = LetsencryptURL
+	}
+	if registered != a.directoryURL() {
+		return fmt.Errorf("account %s is registered with %s, but %s is configured", *a.Email, registered, a.directoryURL())
+	}
+	return nil
+}
@@ -20,6 +20,8 @@ import (
 	"encoding/json"
 	"log"
 
+	"github.com/aws/aws-sdk-go/aws/awserr"
+
 	"github.com/lscheidler/letsencrypt-lambda/account/certificate/privatekey"
 	"github.com/lscheidler/letsencrypt-lambda/crypto"
 	"github.com/lscheidler/letsencrypt-lambda/helper"
@@ -27,11 +29,31 @@ import (
 )
 
 type Registration struct {
-	Key       *privatekey.PrivateKey `json:"privateKey"`
-	Status    string                 `json:"status"`
-	Contact   []string               `json:"contact"`
-	URI       string                 `json:"uri"`
-	OrdersURL string                 `json:"ordersURL"`
+	Key          *privatekey.PrivateKey `json:"privateKey"`
+	Status       string                 `json:"status"`
+	Contact      []string               `json:"contact"`
+	DirectoryURL string                 `json:"directoryURL,omitempty"`
+	URI          string                 `json:"uri"`
+	OrdersURL    string                 `json:"ordersURL"`
+	// ExternalAccountBinding is the key id of the external account, the
+	// registration is bound to
+	ExternalAccountBinding string `json:"externalAccountBinding,omitempty"`
+	// NextKey is the new account key during a key rollover
+	NextKey *privatekey.PrivateKey `json:"nextPrivateKey,omitempty"`
+	// Stale is true, if the registration was decrypted with the previous
+	// issuer passphrase or from a previous format and should be saved again
+	Stale bool `json:"-"`
+	// Email of the account, the encrypted registration is bound to it
+	Email string `json:"-"`
+}
+
+// encryptionContext is the context the encrypted registration is bound to
+func (r *Registration) encryptionContext() map[string]string {
+	return map[string]string{
+		"purpose": "issuer",
+		"type":    "registration",
+		"email":   r.Email,
+	}
 }
 
 type RegistrationCrypt Registration
@@ -40,17 +62,26 @@ func (rc *RegistrationCrypt) UnmarshalJSON(b []byte) error {
 	var jsonData []byte
 	var plaintext []byte
 	var err error
-	var issuerPassphrase *string
-
-	if issuerPassphrase = getIssuerPassphrase(); issuerPassphrase == nil {
-		return nil
-	}
 
 	if err = json.Unmarshal(b, &jsonData); err != nil {
 		return err
 	}
 
-	if plaintext, err = crypto.Decrypt(jsonData, []byte(*issuerPassphrase)); err != nil {
+	passphrase := getIssuerPassphrase
+	if !crypto.IsKMSEnvelope(jsonData) {
+		issuerPassphrase := getIssuerPassphrase()
+		if issuerPassphrase == nil {
+			return nil
+		}
+		passphrase = func() *string { return issuerPassphrase }
+	}
+
+	var stale bool
+	if plaintext, stale, err = crypto.Open(jsonData, passphrase, getPreviousIssuerPassphrase, (*Registration)(rc).encryptionContext()); err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "AccessDeniedException" {
+			log.Println("Access to the KMS key for issuer decryption denied. Not required in client mode.")
+			return nil
+		}
 		return err
 	}
 
@@ -58,6 +89,7 @@ func (rc *RegistrationCrypt) UnmarshalJSON(b []byte) error {
 	if err := json.Unmarshal(plaintext, &r); err != nil {
 		return err
 	}
+	r.Stale = stale
 	*rc = RegistrationCrypt(r)
 	return nil
 }
@@ -66,8 +98,11 @@ func (rc *RegistrationCrypt) MarshalJSON() ([]byte, error) {
 	var ciphertext []byte
 	var issuerPassphrase *string
 
-	if issuerPassphrase = getIssuerPassphrase(); issuerPassphrase == nil {
-		return ciphertext, nil
+	// the issuer passphrase isn't required with KMS
+	if crypto.DefaultKMS() == nil {
+		if issuerPassphrase = getIssuerPassphrase(); issuerPassphrase == nil {
+			return ciphertext, nil
+		}
 	}
 
 	r := Registration(*rc)
@@ -76,7 +111,7 @@ func (rc *RegistrationCrypt) MarshalJSON() ([]byte, error) {
 		return nil, err
 	}
 
-	if ciphertext, err = crypto.Encrypt(plaintext, []byte(*issuerPassphrase)); err != nil {
+	if ciphertext, err = crypto.Seal(plaintext, func() *string { return issuerPassphrase }, r.encryptionContext()); err != nil {
 		return nil, err
 	}
 
@@ -100,3 +135,15 @@ func getIssuerPassphrase() *string {
 		return issuerPassphrase
 	}
 }
+
+// getPreviousIssuerPassphrase returns the issuer passphrase before the last
+// rotation from ISSUER_PASSPHRASE_PREVIOUS or the version stage AWSPREVIOUS
+// of ISSUER_PASSPHRASE_SECRET_ARN
+func getPreviousIssuerPassphrase() *string {
+	if issuerPassphrase := helper.Getenv("ISSUER_PASSPHRASE_PREVIOUS"); issuerPassphrase != nil {
+		return issuerPassphrase
+	} else if issuerPassphraseSecretsArn := helper.Getenv("ISSUER_PASSPHRASE_SECRET_ARN"); issuerPassphraseSecretsArn != nil {
+		return secrets.GetPreviousSecret(issuerPassphraseSecretsArn)
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+/*
+Copyright 2020 Lars Eric Scheidler
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package acm
+
+import (
+	"log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/acm"
+	"github.com/aws/aws-sdk-go/service/acm/acmiface"
+
+	"github.com/lscheidler/letsencrypt-lambda/account/certificate"
+	awshelper "github.com/lscheidler/letsencrypt-lambda/helper/aws"
+)
+
+// ACM exports issued certificates to AWS Certificate Manager
+type ACM struct {
+	// clients per region, the default region has the key ""
+	clients   map[string]acmiface.ACMAPI
+	newClient func(region string) acmiface.ACMAPI
+	// region is the default region, an empty region is unknown
+	region string
+}
+
+func New() *ACM {
+	_, conf := awshelper.GetAwsSession()
+	return &ACM{
+		clients: map[string]acmiface.ACMAPI{},
+		region:  aws.StringValue(conf.Region),
+		newClient: func(region string) acmiface.ACMAPI {
+			sess, conf := awshelper.GetAwsSession()
+			if region != "" {
+				conf.Region = aws.String(region)
+			}
+			return acm.New(sess, conf)
+		},
+	}
+}
+
+// NewWithClient returns an ACM, which uses svc for all regions (e.g. a fake
+// of the ACM API)
+func NewWithClient(svc acmiface.ACMAPI) *ACM {
+	return &ACM{
+		clients: map[string]acmiface.ACMAPI{},
+		newClient: func(region string) acmiface.ACMAPI {
+			return svc
+		},
+	}
+}
+
+// Export imports the leaf, chain and private key of cert into ACM. A
+// certificate, which was already imported, is reimported into the same ARN,
+// unless the region of the ARN isn't the configured region.
+func (a *ACM) Export(config *certificate.Config, cert *certificate.Certificate) error {
+	leaf, chain, key, err := cert.PemParts()
+	if err != nil {
+		return err
+	}
+
+	region := config.ACMRegion
+	if region == "" {
+		region = a.region
+	}
+	if cert.ACMCertificateArn != nil && region != "" {
+		if parsed, err := arn.Parse(*cert.ACMCertificateArn); err == nil && parsed.Region != region {
+			log.Printf("ACM certificate %s isn't in region %s, import as new certificate", *cert.ACMCertificateArn, region)
+			cert.ACMCertificateArn = nil
+		}
+	}
+
+	input := &acm.ImportCertificateInput{
+		Certificate:      leaf,
+		CertificateArn:   cert.ACMCertificateArn,
+		CertificateChain: chain,
+		PrivateKey:       key,
+	}
+	if cert.ACMCertificateArn == nil {
+		// tags can only be applied on the first import
+		input.Tags = []*acm.Tag{
+			{
+				Key:   aws.String("Name"),
+				Value: aws.String(config.Name),
+			},
+		}
+	}
+
+	svc := a.client(config.ACMRegion)
+	result, err := svc.ImportCertificate(input)
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == acm.ErrCodeResourceNotFoundException && cert.ACMCertificateArn != nil {
+		// the certificate was deleted from ACM
+		log.Printf("ACM certificate %s not found, import as new certificate", *cert.ACMCertificateArn)
+		cert.ACMCertificateArn = nil
+		return a.Export(config, cert)
+	} else if err != nil {
+		return err
+	}
+
+	log.Printf("Imported certificate %s into ACM: %s", config.Name, *result.CertificateArn)
+	cert.ACMCertificateArn = result.CertificateArn
+	return nil
+}
+
+func (a *ACM) client(region string) acmiface.ACMAPI {
+	if svc, ok := a.clients[region]; ok {
+		return svc
+	}
+	svc := a.newClient(region)
+	a.clients[region] = svc
+	return svc
+}
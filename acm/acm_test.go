@@ -0,0 +1,196 @@
+/*
+Copyright 2020 Lars Eric Scheidler
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package acm
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/acm"
+	"github.com/aws/aws-sdk-go/service/acm/acmiface"
+
+	"github.com/lscheidler/letsencrypt-lambda/account/certificate"
+)
+
+// fakeACM is a local fake of the ACM API, which stores imported certificates
+// by ARN
+type fakeACM struct {
+	acmiface.ACMAPI
+	region       string
+	certificates map[string][]byte
+	inputs       []*acm.ImportCertificateInput
+}
+
+func newFakeACM(region string) *fakeACM {
+	return &fakeACM{
+		region:       region,
+		certificates: map[string][]byte{},
+	}
+}
+
+func (f *fakeACM) ImportCertificate(input *acm.ImportCertificateInput) (*acm.ImportCertificateOutput, error) {
+	f.inputs = append(f.inputs, input)
+
+	certificateArn := aws.StringValue(input.CertificateArn)
+	if certificateArn == "" {
+		certificateArn = fmt.Sprintf("arn:aws:acm:%s:123456789012:certificate/%d", f.region, len(f.certificates)+1)
+	} else if _, ok := f.certificates[certificateArn]; !ok {
+		return nil, awserr.New(acm.ErrCodeResourceNotFoundException, "certificate "+certificateArn+" not found", nil)
+	}
+	f.certificates[certificateArn] = input.Certificate
+	return &acm.ImportCertificateOutput{CertificateArn: aws.String(certificateArn)}, nil
+}
+
+func TestExportImportsWithTags(t *testing.T) {
+	fake := newFakeACM("eu-central-1")
+	cert := newCertificate(t)
+
+	if err := NewWithClient(fake).Export(&certificate.Config{Name: "example.org"}, cert); err != nil {
+		t.Fatal(err)
+	}
+
+	if cert.ACMCertificateArn == nil {
+		t.Fatal("certificate arn not recorded")
+	}
+	input := fake.inputs[0]
+	if input.CertificateArn != nil {
+		t.Errorf("first import with certificate arn %s", *input.CertificateArn)
+	}
+	if len(input.Tags) != 1 || *input.Tags[0].Key != "Name" || *input.Tags[0].Value != "example.org" {
+		t.Errorf("unexpected tags %v", input.Tags)
+	}
+	if len(input.Certificate) == 0 || len(input.CertificateChain) == 0 || len(input.PrivateKey) == 0 {
+		t.Error("certificate, chain or private key missing")
+	}
+}
+
+func TestExportReimportsIntoSameArn(t *testing.T) {
+	fake := newFakeACM("eu-central-1")
+	a := NewWithClient(fake)
+	config := &certificate.Config{Name: "example.org"}
+	cert := newCertificate(t)
+
+	if err := a.Export(config, cert); err != nil {
+		t.Fatal(err)
+	}
+	certificateArn := *cert.ACMCertificateArn
+
+	if err := a.Export(config, cert); err != nil {
+		t.Fatal(err)
+	}
+
+	if *cert.ACMCertificateArn != certificateArn {
+		t.Errorf("expected arn %s, got %s", certificateArn, *cert.ACMCertificateArn)
+	}
+	input := fake.inputs[1]
+	if aws.StringValue(input.CertificateArn) != certificateArn {
+		t.Errorf("reimport into %s, expected %s", aws.StringValue(input.CertificateArn), certificateArn)
+	}
+	if len(input.Tags) != 0 {
+		t.Errorf("reimport with tags %v", input.Tags)
+	}
+	if len(fake.certificates) != 1 {
+		t.Errorf("expected 1 certificate, got %d", len(fake.certificates))
+	}
+}
+
+func TestExportImportsDeletedCertificateAsNew(t *testing.T) {
+	fake := newFakeACM("eu-central-1")
+	cert := newCertificate(t)
+	cert.ACMCertificateArn = aws.String("arn:aws:acm:eu-central-1:123456789012:certificate/deleted")
+
+	if err := NewWithClient(fake).Export(&certificate.Config{Name: "example.org"}, cert); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fake.inputs) != 2 {
+		t.Fatalf("expected 2 imports, got %d", len(fake.inputs))
+	}
+	if *cert.ACMCertificateArn == "arn:aws:acm:eu-central-1:123456789012:certificate/deleted" {
+		t.Error("deleted certificate arn is still recorded")
+	}
+	if len(fake.inputs[1].Tags) != 1 {
+		t.Errorf("new import without tags")
+	}
+}
+
+func TestExportImportsAsNewInChangedRegion(t *testing.T) {
+	fake := newFakeACM("us-east-1")
+	cert := newCertificate(t)
+	cert.ACMCertificateArn = aws.String("arn:aws:acm:eu-central-1:123456789012:certificate/1")
+
+	config := &certificate.Config{Name: "example.org", ACMRegion: "us-east-1"}
+	if err := NewWithClient(fake).Export(config, cert); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fake.inputs) != 1 || fake.inputs[0].CertificateArn != nil {
+		t.Error("certificate of another region was reimported")
+	}
+	if *cert.ACMCertificateArn != "arn:aws:acm:us-east-1:123456789012:certificate/1" {
+		t.Errorf("unexpected arn %s", *cert.ACMCertificateArn)
+	}
+}
+
+// newCertificate returns a certificate with a self-signed leaf and a
+// self-signed issuer as chain
+func newCertificate(t *testing.T) *certificate.Certificate {
+	var buf bytes.Buffer
+	var leafKey *ecdsa.PrivateKey
+	for index, name := range []string{"example.org", "Test CA"} {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if leafKey == nil {
+			leafKey = key
+		}
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(int64(index + 1)),
+			Subject:      pkix.Name{CommonName: name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(24 * time.Hour),
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: der}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	der, err := x509.MarshalECPrivateKey(leafKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pem.Encode(&buf, &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}); err != nil {
+		t.Fatal(err)
+	}
+	return &certificate.Certificate{Pem: buf.Bytes()}
+}
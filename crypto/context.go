@@ -0,0 +1,70 @@
+/*
+Copyright 2020 Lars Eric Scheidler
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package crypto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sort"
+	"sync"
+)
+
+// ErrUnboundCiphertext is returned in strict mode for ciphertext of a
+// previous format, which isn't bound to its context
+var ErrUnboundCiphertext = errors.New("ciphertext isn't bound to its context")
+
+var (
+	strict      bool
+	strictMutex sync.Mutex
+)
+
+// SetStrict enables the strict mode, which only decrypts ciphertext bound to
+// its context. Otherwise ciphertext of previous formats is still decrypted,
+// so it can be migrated.
+func SetStrict(enabled bool) {
+	strictMutex.Lock()
+	defer strictMutex.Unlock()
+	strict = enabled
+}
+
+func isStrict() bool {
+	strictMutex.Lock()
+	defer strictMutex.Unlock()
+	return strict
+}
+
+// associatedData returns the AEAD additional data for the envelope header
+// and the context (e.g. email, item type and certificate name). The context
+// is length prefixed and sorted by key, so it is unambiguous.
+func associatedData(header []byte, context map[string]string) []byte {
+	keys := []string{}
+	for key := range context {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	buf.Write(header)
+	for _, key := range keys {
+		for _, value := range []string{key, context[key]} {
+			binary.Write(&buf, binary.BigEndian, uint32(len(value)))
+			buf.WriteString(value)
+		}
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,158 @@
+/*
+Copyright 2020 Lars Eric Scheidler
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package crypto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+)
+
+var (
+	certificateContext = map[string]string{"purpose": "client", "type": "certificate", "email": "user@example.org", "name": "a"}
+	swappedContext     = map[string]string{"purpose": "client", "type": "certificate", "email": "user@example.org", "name": "b"}
+)
+
+func TestPassphraseDecryptWithSwappedContext(t *testing.T) {
+	ciphertext, err := EncryptWithPassphrase([]byte("secret"), []byte("passphrase"), certificateContext)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := DecryptWithPassphrase(ciphertext, []byte("passphrase"), swappedContext); err == nil {
+		t.Error("decrypt with swapped context succeeded")
+	}
+	if _, err := DecryptWithPassphrase(ciphertext, []byte("passphrase"), certificateContext); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestKMSDecryptWithSwappedContext(t *testing.T) {
+	k := NewKMSWithClient(newFakeKMS(), "alias/test")
+	ciphertext, err := k.Encrypt([]byte("secret"), certificateContext)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := k.Decrypt(ciphertext, swappedContext); err == nil {
+		t.Error("decrypt with swapped context succeeded")
+	}
+}
+
+func TestAssociatedDataIsUnambiguous(t *testing.T) {
+	a := associatedData(nil, map[string]string{"ab": "c"})
+	b := associatedData(nil, map[string]string{"a": "bc"})
+	if bytes.Equal(a, b) {
+		t.Error("different contexts have the same associated data")
+	}
+}
+
+func TestStrictMode(t *testing.T) {
+	defer SetStrict(false)
+
+	legacy, err := Encrypt([]byte("secret"), []byte(legacyPassphrase))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unboundPassphrase := unboundPassphraseEnvelope(t, []byte("secret"), []byte("passphrase"))
+	k := NewKMSWithClient(newFakeKMS(), "alias/test")
+	unboundKMS := unboundKMSEnvelope(t, k, []byte("secret"), certificateContext["purpose"])
+
+	decrypt := map[string]func() ([]byte, error){
+		"legacy": func() ([]byte, error) {
+			return DecryptWithPassphrase(legacy, []byte(legacyPassphrase), certificateContext)
+		},
+		"unbound passphrase envelope": func() ([]byte, error) {
+			return DecryptWithPassphrase(unboundPassphrase, []byte("passphrase"), certificateContext)
+		},
+		"unbound KMS envelope": func() ([]byte, error) {
+			return k.Decrypt(unboundKMS, certificateContext)
+		},
+	}
+
+	for name, f := range decrypt {
+		SetStrict(false)
+		if plaintext, err := f(); err != nil || string(plaintext) != "secret" {
+			t.Errorf("%s: decrypt without strict mode failed: %v", name, err)
+		}
+
+		SetStrict(true)
+		if _, err := f(); err != ErrUnboundCiphertext {
+			t.Errorf("%s: expected %v in strict mode, got %v", name, ErrUnboundCiphertext, err)
+		}
+	}
+
+	// bound data is still decrypted in strict mode
+	ciphertext, err := EncryptWithPassphrase([]byte("secret"), []byte("passphrase"), certificateContext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecryptWithPassphrase(ciphertext, []byte("passphrase"), certificateContext); err != nil {
+		t.Errorf("decrypt of bound data in strict mode failed: %v", err)
+	}
+}
+
+// unboundPassphraseEnvelope returns a passphrase envelope of version 1, which
+// isn't bound to its context
+func unboundPassphraseEnvelope(t *testing.T, plaintext []byte, passphrase []byte) []byte {
+	params := defaultParams[KDFScrypt]
+	salt := bytes.Repeat([]byte{1}, saltSize)
+	key, err := deriveKey(passphrase, salt, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	buf.Write(passphraseEnvelopeMagic)
+	buf.WriteByte(passphraseEnvelopeVersionUnbound)
+	binary.Write(&buf, binary.BigEndian, params)
+	buf.Write(salt)
+	sealed, err := Encrypt(plaintext, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.Write(sealed)
+	return buf.Bytes()
+}
+
+// unboundKMSEnvelope returns a KMS envelope of version 1, which is bound to
+// the purpose only
+func unboundKMSEnvelope(t *testing.T, k *KMS, plaintext []byte, purpose string) []byte {
+	result, err := k.svc.GenerateDataKey(&kms.GenerateDataKeyInput{
+		EncryptionContext: aws.StringMap(map[string]string{"purpose": purpose}),
+		KeyId:             aws.String(k.keyId),
+		KeySpec:           aws.String(kms.DataKeySpecAes256),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	buf.Write(kmsEnvelopeMagic)
+	buf.WriteByte(kmsEnvelopeVersionUnbound)
+	binary.Write(&buf, binary.BigEndian, uint16(len(result.CiphertextBlob)))
+	buf.Write(result.CiphertextBlob)
+	sealed, err := Encrypt(plaintext, result.Plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.Write(sealed)
+	return buf.Bytes()
+}
@@ -21,6 +21,7 @@ import (
 	"crypto/cipher"
 	"crypto/ecdsa"
 	"crypto/rand"
+	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
@@ -32,6 +33,12 @@ import (
 // form nonce|ciphertext|tag where '|' indicates concatenation.
 // source: https://github.com/gtank/cryptopasta/blob/master/encrypt.go (bc3a108a5776376aa811eea34b93383837994340)
 func Encrypt(plaintext []byte, key []byte) (ciphertext []byte, err error) {
+	return encryptAEAD(plaintext, key, nil)
+}
+
+// encryptAEAD encrypts like Encrypt and authenticates additionalData, which
+// isn't part of the ciphertext
+func encryptAEAD(plaintext []byte, key []byte, additionalData []byte) (ciphertext []byte, err error) {
 	if len(key) < 32 {
 		return nil, errors.New("The key should have at least 32 characters.")
 	}
@@ -52,13 +59,19 @@ func Encrypt(plaintext []byte, key []byte) (ciphertext []byte, err error) {
 		return nil, err
 	}
 
-	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+	return gcm.Seal(nonce, nonce, plaintext, additionalData), nil
 }
 
 // Decrypt decrypts data using 256-bit AES-GCM.  This both hides the content of
 // the data and provides a check that it hasn't been altered. Expects input
 // form nonce|ciphertext|tag where '|' indicates concatenation.
 func Decrypt(ciphertext []byte, key []byte) (plaintext []byte, err error) {
+	return decryptAEAD(ciphertext, key, nil)
+}
+
+// decryptAEAD decrypts ciphertext encrypted by encryptAEAD with the same
+// additionalData
+func decryptAEAD(ciphertext []byte, key []byte, additionalData []byte) (plaintext []byte, err error) {
 	block, err := aes.NewCipher(key[:])
 	if err != nil {
 		return nil, err
@@ -76,7 +89,7 @@ func Decrypt(ciphertext []byte, key []byte) (plaintext []byte, err error) {
 	return gcm.Open(nil,
 		ciphertext[:gcm.NonceSize()],
 		ciphertext[gcm.NonceSize():],
-		nil,
+		additionalData,
 	)
 }
 
@@ -89,3 +102,8 @@ func EncodeECDSAKey(w io.Writer, key *ecdsa.PrivateKey) error {
 	pb := &pem.Block{Type: "EC PRIVATE KEY", Bytes: b}
 	return pem.Encode(w, pb)
 }
+
+func EncodeRSAKey(w io.Writer, key *rsa.PrivateKey) error {
+	pb := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	return pem.Encode(w, pb)
+}
@@ -0,0 +1,241 @@
+/*
+Copyright 2020 Lars Eric Scheidler
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package crypto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+
+	awshelper "github.com/lscheidler/letsencrypt-lambda/helper/aws"
+)
+
+const (
+	// kmsEnvelopeVersion 1 is bound to the purpose of the encryption context
+	// only, version 2 to the whole context (KMS encryption context and AEAD
+	// additional data)
+	kmsEnvelopeVersionUnbound = 1
+	kmsEnvelopeVersion        = 2
+)
+
+// kmsEnvelopeMagic identifies data encrypted with a KMS data key
+var kmsEnvelopeMagic = []byte("LKMS")
+
+var (
+	defaultKMS      *KMS
+	defaultKMSMutex sync.Mutex
+)
+
+// KMS encrypts data with envelope encryption: every blob is encrypted with a
+// new data key of the KMS key, which is stored wrapped by KMS next to the
+// ciphertext. Output takes the form
+// magic|version|length of wrapped key|wrapped key|nonce|ciphertext|tag.
+type KMS struct {
+	svc   kmsiface.KMSAPI
+	keyId string
+}
+
+// NewKMS returns KMS for the key keyId (key id, key arn or alias)
+func NewKMS(keyId string) *KMS {
+	sess, conf := awshelper.GetAwsSession()
+	return NewKMSWithClient(kms.New(sess, conf), keyId)
+}
+
+// NewKMSWithClient returns KMS, which uses svc (e.g. a local stand-in)
+func NewKMSWithClient(svc kmsiface.KMSAPI, keyId string) *KMS {
+	return &KMS{
+		svc:   svc,
+		keyId: keyId,
+	}
+}
+
+// SetDefaultKMS sets the KMS, which is used by Seal for new data. nil
+// disables KMS encryption.
+func SetDefaultKMS(k *KMS) {
+	defaultKMSMutex.Lock()
+	defer defaultKMSMutex.Unlock()
+	defaultKMS = k
+}
+
+// DefaultKMS returns the KMS set with SetDefaultKMS or nil
+func DefaultKMS() *KMS {
+	defaultKMSMutex.Lock()
+	defer defaultKMSMutex.Unlock()
+	return defaultKMS
+}
+
+// Encrypt encrypts plaintext with a new data key. context is the encryption
+// context, which is required for decryption and can be used in key policies.
+// It is authenticated as additional data as well.
+func (k *KMS) Encrypt(plaintext []byte, context map[string]string) ([]byte, error) {
+	result, err := k.svc.GenerateDataKey(&kms.GenerateDataKeyInput{
+		EncryptionContext: aws.StringMap(context),
+		KeyId:             aws.String(k.keyId),
+		KeySpec:           aws.String(kms.DataKeySpecAes256),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer zero(result.Plaintext)
+
+	if len(result.CiphertextBlob) > 0xffff {
+		return nil, errors.New("wrapped data key is too long")
+	}
+
+	var buf bytes.Buffer
+	buf.Write(kmsEnvelopeMagic)
+	buf.WriteByte(kmsEnvelopeVersion)
+	binary.Write(&buf, binary.BigEndian, uint16(len(result.CiphertextBlob)))
+	buf.Write(result.CiphertextBlob)
+
+	sealed, err := encryptAEAD(plaintext, result.Plaintext, associatedData(buf.Bytes(), context))
+	if err != nil {
+		return nil, err
+	}
+	buf.Write(sealed)
+	return buf.Bytes(), nil
+}
+
+// Decrypt decrypts ciphertext, which was encrypted by Encrypt with the same
+// encryption context. The KMS key is determined by the wrapped data key.
+func (k *KMS) Decrypt(ciphertext []byte, context map[string]string) ([]byte, error) {
+	if !IsKMSEnvelope(ciphertext) {
+		return nil, errors.New("not a KMS envelope")
+	}
+
+	r := bytes.NewReader(ciphertext[len(kmsEnvelopeMagic):])
+	version, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	switch version {
+	case kmsEnvelopeVersion:
+	case kmsEnvelopeVersionUnbound:
+		if isStrict() {
+			return nil, ErrUnboundCiphertext
+		}
+		context = map[string]string{"purpose": context["purpose"]}
+	default:
+		return nil, errors.New("unsupported KMS envelope version")
+	}
+
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, errors.New("malformed KMS envelope")
+	}
+	wrappedKey := make([]byte, length)
+	if _, err := io.ReadFull(r, wrappedKey); err != nil {
+		return nil, errors.New("malformed KMS envelope")
+	}
+
+	result, err := k.svc.Decrypt(&kms.DecryptInput{
+		CiphertextBlob:    wrappedKey,
+		EncryptionContext: aws.StringMap(context),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer zero(result.Plaintext)
+
+	header := ciphertext[:len(ciphertext)-r.Len()]
+	sealed := ciphertext[len(header):]
+	if version == kmsEnvelopeVersionUnbound {
+		return Decrypt(sealed, result.Plaintext)
+	}
+	return decryptAEAD(sealed, result.Plaintext, associatedData(header, context))
+}
+
+// IsKMSEnvelope returns true, if ciphertext was encrypted by KMS.Encrypt
+func IsKMSEnvelope(ciphertext []byte) bool {
+	return bytes.HasPrefix(ciphertext, kmsEnvelopeMagic)
+}
+
+// IsCurrent returns true, if ciphertext is encrypted like Seal would encrypt
+// it now. Otherwise it should be encrypted again (e.g. after KMS was enabled
+// or data of the previous format without key derivation).
+func IsCurrent(ciphertext []byte) bool {
+	if DefaultKMS() != nil {
+		return envelopeVersion(ciphertext, kmsEnvelopeMagic) == kmsEnvelopeVersion
+	}
+	return envelopeVersion(ciphertext, passphraseEnvelopeMagic) == passphraseEnvelopeVersion
+}
+
+// envelopeVersion returns the version of the envelope identified by magic or
+// -1, if ciphertext isn't such an envelope
+func envelopeVersion(ciphertext []byte, magic []byte) int {
+	if len(ciphertext) <= len(magic) || !bytes.HasPrefix(ciphertext, magic) {
+		return -1
+	}
+	return int(ciphertext[len(magic)])
+}
+
+// Seal encrypts plaintext with the default KMS, if it is set, otherwise with
+// a key derived from the passphrase. passphrase is only called, if it is required.
+func Seal(plaintext []byte, passphrase func() *string, context map[string]string) ([]byte, error) {
+	if k := DefaultKMS(); k != nil {
+		return k.Encrypt(plaintext, context)
+	}
+	p := passphrase()
+	if p == nil {
+		return nil, errors.New("passphrase not found")
+	}
+	return EncryptWithPassphrase(plaintext, []byte(*p), context)
+}
+
+// Open decrypts ciphertext, which was encrypted by Seal. Data encrypted with
+// the passphrase can still be decrypted, if KMS is enabled, and KMS envelopes
+// can be decrypted without a default KMS. If the decryption with passphrase
+// fails, it is retried with previous (e.g. during a passphrase rotation),
+// previous can be nil. stale is true, if ciphertext should be encrypted again
+// with Seal.
+func Open(ciphertext []byte, passphrase, previous func() *string, context map[string]string) (plaintext []byte, stale bool, err error) {
+	if IsKMSEnvelope(ciphertext) {
+		k := DefaultKMS()
+		if k == nil {
+			k = NewKMS("")
+		}
+		plaintext, err = k.Decrypt(ciphertext, context)
+		return plaintext, !IsCurrent(ciphertext), err
+	}
+
+	err = errors.New("passphrase not found")
+	if p := passphrase(); p != nil {
+		if plaintext, err = DecryptWithPassphrase(ciphertext, []byte(*p), context); err == nil {
+			return plaintext, !IsCurrent(ciphertext), nil
+		}
+	}
+	if previous != nil {
+		if p := previous(); p != nil {
+			if plaintext, previousErr := DecryptWithPassphrase(ciphertext, []byte(*p), context); previousErr == nil {
+				return plaintext, true, nil
+			}
+		}
+	}
+	return nil, false, err
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
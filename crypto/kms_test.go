@@ -0,0 +1,140 @@
+/*
+Copyright 2020 Lars Eric Scheidler
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+)
+
+// fakeKMS is a local stand-in of the KMS API. Data keys are "wrapped" by
+// remembering them with their encryption context, decryption requires the
+// same encryption context like KMS.
+type fakeKMS struct {
+	kmsiface.KMSAPI
+
+	mutex    sync.Mutex
+	dataKeys map[string]fakeDataKey
+}
+
+type fakeDataKey struct {
+	plaintext []byte
+	context   map[string]*string
+}
+
+func newFakeKMS() *fakeKMS {
+	return &fakeKMS{dataKeys: map[string]fakeDataKey{}}
+}
+
+func (f *fakeKMS) GenerateDataKey(input *kms.GenerateDataKeyInput) (*kms.GenerateDataKeyOutput, error) {
+	plaintext := make([]byte, 32)
+	if _, err := rand.Read(plaintext); err != nil {
+		return nil, err
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	blob := fmt.Sprintf("%s/%d", aws.StringValue(input.KeyId), len(f.dataKeys))
+	f.dataKeys[blob] = fakeDataKey{plaintext: plaintext, context: input.EncryptionContext}
+
+	// the caller zeroes the plaintext key
+	return &kms.GenerateDataKeyOutput{
+		CiphertextBlob: []byte(blob),
+		KeyId:          input.KeyId,
+		Plaintext:      append([]byte{}, plaintext...),
+	}, nil
+}
+
+func (f *fakeKMS) Decrypt(input *kms.DecryptInput) (*kms.DecryptOutput, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	dataKey, ok := f.dataKeys[string(input.CiphertextBlob)]
+	if !ok || !reflect.DeepEqual(aws.StringValueMap(dataKey.context), aws.StringValueMap(input.EncryptionContext)) {
+		return nil, awserr.New(kms.ErrCodeInvalidCiphertextException, "invalid ciphertext", nil)
+	}
+	return &kms.DecryptOutput{Plaintext: append([]byte{}, dataKey.plaintext...)}, nil
+}
+
+func TestKMSRoundTrip(t *testing.T) {
+	k := NewKMSWithClient(newFakeKMS(), "alias/test")
+	context := map[string]string{"purpose": "client", "email": "user@example.org"}
+
+	ciphertext, err := k.Encrypt([]byte("secret"), context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsKMSEnvelope(ciphertext) {
+		t.Fatal("ciphertext isn't a KMS envelope")
+	}
+	if bytes.Contains(ciphertext, []byte("secret")) {
+		t.Fatal("ciphertext contains the plaintext")
+	}
+
+	plaintext, err := k.Decrypt(ciphertext, context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "secret" {
+		t.Errorf("expected secret, got %s", plaintext)
+	}
+}
+
+func TestKMSDecryptWithMismatchedContext(t *testing.T) {
+	k := NewKMSWithClient(newFakeKMS(), "alias/test")
+
+	ciphertext, err := k.Encrypt([]byte("secret"), map[string]string{"purpose": "client", "email": "user@example.org"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := k.Decrypt(ciphertext, map[string]string{"purpose": "issuer", "email": "user@example.org"}); err == nil {
+		t.Error("decrypt with mismatched context succeeded")
+	}
+}
+
+func TestSealAndOpenWithDefaultKMS(t *testing.T) {
+	SetDefaultKMS(NewKMSWithClient(newFakeKMS(), "alias/test"))
+	defer SetDefaultKMS(nil)
+
+	context := map[string]string{"purpose": "issuer"}
+	noPassphrase := func() *string {
+		t.Error("passphrase requested with KMS")
+		return nil
+	}
+
+	ciphertext, err := Seal([]byte("secret"), noPassphrase, context)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plaintext, stale, err := Open(ciphertext, noPassphrase, nil, context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "secret" || stale {
+		t.Errorf("unexpected plaintext %s (stale %v)", plaintext, stale)
+	}
+}
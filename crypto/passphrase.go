@@ -0,0 +1,265 @@
+/*
+Copyright 2020 Lars Eric Scheidler
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// KDF is the key derivation function for passphrases
+type KDF byte
+
+const (
+	// KDFScrypt derives the key with scrypt (N=2^15, r=8, p=1)
+	KDFScrypt KDF = 1
+	// KDFArgon2id derives the key with Argon2id (t=3, m=64MiB, p=1)
+	KDFArgon2id KDF = 2
+
+	// passphraseEnvelopeVersion 1 isn't bound to a context, version 2 is
+	// bound to the context by AEAD additional data
+	passphraseEnvelopeVersionUnbound = 1
+	passphraseEnvelopeVersion        = 2
+	saltSize                         = 16
+	keySize                          = 32
+)
+
+// passphraseEnvelopeMagic identifies data encrypted with a key derived from
+// a passphrase
+var passphraseEnvelopeMagic = []byte("LPWD")
+
+// kdfParams are the parameters of a KDF, they are stored in the envelope
+type kdfParams struct {
+	KDF KDF
+	// scrypt: log2(N), r, p; Argon2id: time, memory in KiB, threads
+	P1, P2, P3 uint32
+}
+
+var defaultParams = map[KDF]kdfParams{
+	KDFScrypt:   {KDF: KDFScrypt, P1: 15, P2: 8, P3: 1},
+	KDFArgon2id: {KDF: KDFArgon2id, P1: 3, P2: 64 * 1024, P3: 1},
+}
+
+var (
+	defaultKDF = KDFScrypt
+
+	// derivedKeys caches derived keys per passphrase, salt and parameters,
+	// because the derivation is expensive by design
+	derivedKeys      = map[[sha256.Size]byte][]byte{}
+	encryptionSalts  = map[[sha256.Size]byte][]byte{}
+	derivedKeysMutex sync.Mutex
+)
+
+// ParseKDF returns the KDF for name (scrypt, argon2id)
+func ParseKDF(name string) (KDF, error) {
+	switch name {
+	case "scrypt":
+		return KDFScrypt, nil
+	case "argon2id":
+		return KDFArgon2id, nil
+	default:
+		return 0, fmt.Errorf("unknown key derivation function %s", name)
+	}
+}
+
+// SetDefaultKDF sets the KDF for new data, default is KDFScrypt
+func SetDefaultKDF(kdf KDF) {
+	derivedKeysMutex.Lock()
+	defer derivedKeysMutex.Unlock()
+	defaultKDF = kdf
+}
+
+// EncryptWithPassphrase encrypts plaintext with a key, which is derived from
+// passphrase. The header and context (e.g. email, item type and certificate
+// name) are authenticated as additional data, so the ciphertext can only be
+// decrypted with the same context. Output takes the form
+// magic|version|kdf|p1|p2|p3|salt|nonce|ciphertext|tag.
+func EncryptWithPassphrase(plaintext []byte, passphrase []byte, context map[string]string) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("passphrase is empty")
+	}
+
+	derivedKeysMutex.Lock()
+	params := defaultParams[defaultKDF]
+	derivedKeysMutex.Unlock()
+
+	// the salt is reused for all data of a passphrase in this process, so the
+	// key is only derived once
+	salt, err := encryptionSalt(passphrase, params)
+	if err != nil {
+		return nil, err
+	}
+	key, err := deriveKey(passphrase, salt, params)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.Write(passphraseEnvelopeMagic)
+	buf.WriteByte(passphraseEnvelopeVersion)
+	binary.Write(&buf, binary.BigEndian, params)
+	buf.Write(salt)
+
+	sealed, err := encryptAEAD(plaintext, key, associatedData(buf.Bytes(), context))
+	if err != nil {
+		return nil, err
+	}
+	buf.Write(sealed)
+	return buf.Bytes(), nil
+}
+
+// DecryptWithPassphrase decrypts ciphertext, which was encrypted by
+// EncryptWithPassphrase with the same context. Data encrypted by Encrypt with
+// the passphrase as key (previous format without version and salt) is still
+// decrypted, unless strict mode is enabled.
+func DecryptWithPassphrase(ciphertext []byte, passphrase []byte, context map[string]string) ([]byte, error) {
+	if !IsPassphraseEnvelope(ciphertext) {
+		return decryptUnbound(ciphertext, passphrase)
+	}
+
+	plaintext, err := decryptPassphraseEnvelope(ciphertext, passphrase, context)
+	if err != nil {
+		// the random nonce of the previous format can start with the magic
+		if legacy, legacyErr := decryptUnbound(ciphertext, passphrase); legacyErr == nil {
+			return legacy, nil
+		}
+		return nil, err
+	}
+	return plaintext, nil
+}
+
+// decryptUnbound decrypts ciphertext of the previous format, which used the
+// passphrase as key
+func decryptUnbound(ciphertext []byte, passphrase []byte) ([]byte, error) {
+	if isStrict() {
+		return nil, ErrUnboundCiphertext
+	}
+	return Decrypt(ciphertext, passphrase)
+}
+
+// IsPassphraseEnvelope returns true, if ciphertext was encrypted by
+// EncryptWithPassphrase
+func IsPassphraseEnvelope(ciphertext []byte) bool {
+	return bytes.HasPrefix(ciphertext, passphraseEnvelopeMagic)
+}
+
+func decryptPassphraseEnvelope(ciphertext []byte, passphrase []byte, context map[string]string) ([]byte, error) {
+	r := bytes.NewReader(ciphertext[len(passphraseEnvelopeMagic):])
+	version, err := r.ReadByte()
+	if err != nil {
+		return nil, errors.New("malformed passphrase envelope")
+	}
+	switch version {
+	case passphraseEnvelopeVersion:
+	case passphraseEnvelopeVersionUnbound:
+		if isStrict() {
+			return nil, ErrUnboundCiphertext
+		}
+	default:
+		return nil, errors.New("unsupported passphrase envelope version")
+	}
+
+	var params kdfParams
+	if err := binary.Read(r, binary.BigEndian, &params); err != nil {
+		return nil, errors.New("malformed passphrase envelope")
+	}
+	salt := make([]byte, saltSize)
+	if _, err := io.ReadFull(r, salt); err != nil {
+		return nil, errors.New("malformed passphrase envelope")
+	}
+
+	key, err := deriveKey(passphrase, salt, params)
+	if err != nil {
+		return nil, err
+	}
+	header := ciphertext[:len(ciphertext)-r.Len()]
+	sealed := ciphertext[len(header):]
+	if version == passphraseEnvelopeVersionUnbound {
+		return Decrypt(sealed, key)
+	}
+	return decryptAEAD(sealed, key, associatedData(header, context))
+}
+
+// deriveKey derives the key from passphrase and salt with params
+func deriveKey(passphrase []byte, salt []byte, params kdfParams) ([]byte, error) {
+	id := cacheId(passphrase, salt, params)
+	derivedKeysMutex.Lock()
+	key, ok := derivedKeys[id]
+	derivedKeysMutex.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	switch params.KDF {
+	case KDFScrypt:
+		if params.P1 < 10 || params.P1 > 20 {
+			return nil, errors.New("unsupported scrypt parameters")
+		}
+		var err error
+		if key, err = scrypt.Key(passphrase, salt, 1<<params.P1, int(params.P2), int(params.P3), keySize); err != nil {
+			return nil, err
+		}
+	case KDFArgon2id:
+		if params.P1 == 0 || params.P1 > 10 || params.P2 < 8*1024 || params.P2 > 1024*1024 || params.P3 == 0 || params.P3 > 255 {
+			return nil, errors.New("unsupported argon2id parameters")
+		}
+		key = argon2.IDKey(passphrase, salt, params.P1, params.P2, uint8(params.P3), keySize)
+	default:
+		return nil, fmt.Errorf("unknown key derivation function %d", params.KDF)
+	}
+
+	derivedKeysMutex.Lock()
+	derivedKeys[id] = key
+	derivedKeysMutex.Unlock()
+	return key, nil
+}
+
+// encryptionSalt returns the salt for new data encrypted with passphrase
+func encryptionSalt(passphrase []byte, params kdfParams) ([]byte, error) {
+	id := cacheId(passphrase, nil, params)
+	derivedKeysMutex.Lock()
+	defer derivedKeysMutex.Unlock()
+	if salt, ok := encryptionSalts[id]; ok {
+		return salt, nil
+	}
+
+	salt := make([]byte, saltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	encryptionSalts[id] = salt
+	return salt, nil
+}
+
+func cacheId(passphrase []byte, salt []byte, params kdfParams) [sha256.Size]byte {
+	h := sha256.New()
+	binary.Write(h, binary.BigEndian, params)
+	h.Write(salt)
+	h.Write(passphrase)
+	var id [sha256.Size]byte
+	copy(id[:], h.Sum(nil))
+	return id
+}
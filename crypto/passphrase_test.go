@@ -0,0 +1,130 @@
+/*
+Copyright 2020 Lars Eric Scheidler
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package crypto
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// legacyPassphrase is usable as key of the previous format, which required
+// at least 32 characters
+const legacyPassphrase = "0123456789abcdef0123456789abcdef"
+
+func TestPassphraseRoundTrip(t *testing.T) {
+	defer SetDefaultKDF(KDFScrypt)
+
+	context := map[string]string{"purpose": "client"}
+	for _, kdf := range []KDF{KDFScrypt, KDFArgon2id} {
+		SetDefaultKDF(kdf)
+
+		ciphertext, err := EncryptWithPassphrase([]byte("secret"), []byte("passphrase"), context)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if envelopeVersion(ciphertext, passphraseEnvelopeMagic) != passphraseEnvelopeVersion {
+			t.Errorf("kdf %d: unexpected envelope version", kdf)
+		}
+		if KDF(ciphertext[len(passphraseEnvelopeMagic)+1]) != kdf {
+			t.Errorf("kdf %d: kdf isn't stored in the envelope", kdf)
+		}
+
+		plaintext, err := DecryptWithPassphrase(ciphertext, []byte("passphrase"), context)
+		if err != nil {
+			t.Fatalf("kdf %d: %v", kdf, err)
+		}
+		if string(plaintext) != "secret" {
+			t.Errorf("kdf %d: expected secret, got %s", kdf, plaintext)
+		}
+
+		if _, err := DecryptWithPassphrase(ciphertext, []byte("wrong"), context); err == nil {
+			t.Errorf("kdf %d: decrypt with wrong passphrase succeeded", kdf)
+		}
+	}
+}
+
+func TestDecryptLegacyFormat(t *testing.T) {
+	ciphertext, err := Encrypt([]byte("secret"), []byte(legacyPassphrase))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plaintext, err := DecryptWithPassphrase(ciphertext, []byte(legacyPassphrase), map[string]string{"purpose": "client"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "secret" {
+		t.Errorf("expected secret, got %s", plaintext)
+	}
+}
+
+func TestOpenMarksLegacyFormatStale(t *testing.T) {
+	ciphertext, err := Encrypt([]byte("secret"), []byte(legacyPassphrase))
+	if err != nil {
+		t.Fatal(err)
+	}
+	passphrase := func() *string { return aws.String(legacyPassphrase) }
+	context := map[string]string{"purpose": "client"}
+
+	plaintext, stale, err := Open(ciphertext, passphrase, nil, context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "secret" || !stale {
+		t.Errorf("unexpected plaintext %s (stale %v)", plaintext, stale)
+	}
+
+	// data encrypted again with Seal is current
+	if ciphertext, err = Seal(plaintext, passphrase, context); err != nil {
+		t.Fatal(err)
+	}
+	if _, stale, err = Open(ciphertext, passphrase, nil, context); err != nil || stale {
+		t.Errorf("sealed data is stale (%v)", err)
+	}
+}
+
+func TestOpenWithPreviousPassphrase(t *testing.T) {
+	context := map[string]string{"purpose": "client"}
+	ciphertext, err := Seal([]byte("secret"), func() *string { return aws.String("a") }, context)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// after the rotation from a to b, a is the previous passphrase
+	current := func() *string { return aws.String("b") }
+	previous := func() *string { return aws.String("a") }
+	plaintext, stale, err := Open(ciphertext, current, previous, context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "secret" || !stale {
+		t.Errorf("unexpected plaintext %s (stale %v)", plaintext, stale)
+	}
+
+	if _, _, err := Open(ciphertext, current, nil, context); err == nil {
+		t.Error("open without previous passphrase succeeded")
+	}
+
+	// data encrypted with the current passphrase isn't stale
+	if ciphertext, err = Seal(plaintext, current, context); err != nil {
+		t.Fatal(err)
+	}
+	if _, stale, err = Open(ciphertext, current, previous, context); err != nil || stale {
+		t.Errorf("data of the current passphrase is stale (%v)", err)
+	}
+}
@@ -44,3 +44,13 @@ func GetAwsSession() (*session.Session, *aws.Config) {
 	}
 	return sess, conf
 }
+
+// GetAwsSessionWithRole returns a session like GetAwsSession, which assumes
+// role. If ASSUME_ROLE is set, role is assumed with the credentials of
+// ASSUME_ROLE.
+func GetAwsSessionWithRole(role string) (*session.Session, *aws.Config) {
+	sess, conf := GetAwsSession()
+	log.Println("getAwsSessionWithRole: assume role ", role)
+	conf.Credentials = stscreds.NewCredentials(sess.Copy(conf), role)
+	return sess, conf
+}
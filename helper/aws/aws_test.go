@@ -0,0 +1,47 @@
+/*
+Copyright 2020 Lars Eric Scheidler
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"testing"
+)
+
+// TestRoleSessionIsSeparate checks, that a role session, e.g. of a route53
+// hosted zone, doesn't change the sessions of DynamoDB, S3 and Secrets
+// Manager clients
+func TestRoleSessionIsSeparate(t *testing.T) {
+	t.Setenv("ASSUME_ROLE", "")
+
+	_, roleConf := GetAwsSessionWithRole("arn:aws:iam::111111111111:role/route53")
+	if roleConf.Credentials == nil {
+		t.Fatal("role session without role credentials")
+	}
+
+	sess, conf := GetAwsSession()
+	if conf.Credentials != nil {
+		t.Error("session without role has credentials of another role")
+	}
+	if sess.Config.Credentials == roleConf.Credentials {
+		t.Error("session without role shares the role credentials")
+	}
+
+	t.Setenv("ASSUME_ROLE", "arn:aws:iam::111111111111:role/lambda")
+	_, roleConf = GetAwsSessionWithRole("arn:aws:iam::111111111111:role/route53")
+	if _, conf = GetAwsSession(); conf.Credentials == nil || conf.Credentials == roleConf.Credentials {
+		t.Error("session with ASSUME_ROLE uses the credentials of another role")
+	}
+}
@@ -17,25 +17,65 @@ limitations under the License.
 package main
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"log"
+	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/aws/aws-lambda-go/lambda"
+	"golang.org/x/crypto/acme"
 
 	"github.com/lscheidler/letsencrypt-lambda/account"
-	"github.com/lscheidler/letsencrypt-lambda/dynamodb"
+	"github.com/lscheidler/letsencrypt-lambda/account/certificate"
+	"github.com/lscheidler/letsencrypt-lambda/account/certificate/privatekey"
+	"github.com/lscheidler/letsencrypt-lambda/acm"
+	"github.com/lscheidler/letsencrypt-lambda/crypto"
 	"github.com/lscheidler/letsencrypt-lambda/helper"
 	"github.com/lscheidler/letsencrypt-lambda/provider"
+	"github.com/lscheidler/letsencrypt-lambda/provider/dns/cloudflare"
+	"github.com/lscheidler/letsencrypt-lambda/provider/dns/rfc2136"
 	"github.com/lscheidler/letsencrypt-lambda/provider/dns/route53"
+	"github.com/lscheidler/letsencrypt-lambda/secrets"
+	"github.com/lscheidler/letsencrypt-lambda/storage"
+	"github.com/lscheidler/letsencrypt-lambda/storage/dynamodb"
+	"github.com/lscheidler/letsencrypt-lambda/storage/file"
+	"github.com/lscheidler/letsencrypt-lambda/storage/s3"
 )
 
 type env struct {
-	awsHostedZoneId   *string
-	debug             bool
-	domains           []string
-	dynamodbTableName *string
-	email             *string
+	awsDomainRoles       map[string]string
+	awsHostedZoneId      *string
+	awsHostedZoneRoles   map[string]string
+	awsHostedZones       map[string]string
+	cloudflareAPIURL     string
+	caBundle             *string
+	certificates         []certificate.Config
+	debug                bool
+	directoryURL         string
+	dnsProvider          string
+	dnsProviders         []string
+	eab                  *acme.ExternalAccountBinding
+	kmsKeyId             *string
+	passphraseKDF        crypto.KDF
+	rfc2136Nameserver    *string
+	rfc2136TSIGAlgorithm string
+	rfc2136TSIGKey       *string
+	rfc2136Zone          *string
+	strictEncryption     bool
+	dynamodbTableName    *string
+	dynamodbOptions      *dynamodb.TableOptions
+	email                *string
+	s3Bucket             *string
+	s3Endpoint           *string
+	s3ForcePathStyle     bool
+	s3Prefix             string
+	storageBackend       string
+	storageDirectory     string
 }
 
 func loadEnv() *env {
@@ -52,46 +92,302 @@ func loadEnv() *env {
 
 	if domainsStr := helper.Getenv("DOMAINS"); domainsStr != nil {
 		domains := strings.Split(*domainsStr, ",")
-		for index := range domains {
-			env.domains = append(env.domains, domains[index])
+		// the name of the certificate is compatible to certificates created by
+		// previous versions
+		env.certificates = append(env.certificates, certificate.Config{
+			Name:    fmt.Sprintf("%v", domains),
+			Domains: domains,
+		})
+	}
+
+	if certificatesStr := helper.Getenv("CERTIFICATES"); certificatesStr != nil {
+		var certificates []certificate.Config
+		if err := json.Unmarshal([]byte(*certificatesStr), &certificates); err != nil {
+			log.Println("Environment variable CERTIFICATES is invalid:", err)
+			return nil
 		}
-	} else {
-		log.Println("Environment variable DOMAINS not found.")
-		return nil
+		env.certificates = append(env.certificates, certificates...)
 	}
 
-	if awsHostedZoneId := helper.Getenv("AWS_HOSTED_ZONE_ID"); awsHostedZoneId != nil {
-		env.awsHostedZoneId = awsHostedZoneId
-	} else {
-		log.Println("Environment variable AWS_HOSTED_ZONE_ID not found.")
+	if len(env.certificates) == 0 {
+		log.Println("Environment variable DOMAINS and CERTIFICATES not found. One of these environment variables must be set.")
 		return nil
 	}
 
+	names := map[string]bool{}
+	for index := range env.certificates {
+		config := &env.certificates[index]
+		if config.Name == "" || len(config.Domains) == 0 {
+			log.Println("Certificate name and domains are required:", config)
+			return nil
+		} else if names[config.Name] {
+			log.Println("Certificate name must be unique:", config.Name)
+			return nil
+		}
+		names[config.Name] = true
+
+		if config.RenewBeforeRatio < 0 || config.RenewBeforeRatio >= 1 {
+			log.Println("Certificate", config.Name, "is invalid: renewBeforeRatio must be between 0 and 1")
+			return nil
+		}
+
+		switch config.KeyPolicy {
+		case "", certificate.KeyPolicyReuse, certificate.KeyPolicyRotate:
+		case certificate.KeyPolicyMaxAge:
+			if config.KeyMaxAge <= 0 {
+				log.Println("Certificate", config.Name, "is invalid: keyMaxAge is required for key policy", config.KeyPolicy)
+				return nil
+			}
+		default:
+			log.Println("Certificate", config.Name, "is invalid: unknown key policy", config.KeyPolicy)
+			return nil
+		}
+
+		if keyType, err := privatekey.ParseKeyType(string(config.KeyType)); err != nil {
+			log.Println("Certificate", config.Name, "is invalid:", err)
+			return nil
+		} else {
+			config.KeyType = keyType
+		}
+	}
+
+	env.directoryURL = account.DirectoryURL
+	if directory := helper.Getenv("ACME_DIRECTORY_URL"); directory != nil {
+		if directoryURL, err := account.ResolveDirectoryURL(*directory); err != nil {
+			log.Println("Environment variable ACME_DIRECTORY_URL is invalid:", err)
+			return nil
+		} else {
+			env.directoryURL = directoryURL
+		}
+	}
+
+	env.caBundle = helper.Getenv("ACME_CA_BUNDLE")
+
+	if eabKid := helper.Getenv("ACME_EAB_KID"); eabKid != nil {
+		eabHmacKey := helper.Getenv("ACME_EAB_HMAC_KEY")
+		if eabHmacKey == nil {
+			if eabHmacKeySecretArn := helper.Getenv("ACME_EAB_HMAC_KEY_SECRET_ARN"); eabHmacKeySecretArn != nil {
+				eabHmacKey = secrets.GetSecret(eabHmacKeySecretArn)
+			}
+		}
+		if eabHmacKey == nil {
+			log.Println("Environment variable ACME_EAB_HMAC_KEY and ACME_EAB_HMAC_KEY_SECRET_ARN not found. One of these environment variables must be set, if ACME_EAB_KID is set.")
+			return nil
+		}
+
+		// the hmac key is provided base64url encoded by the CA
+		key, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(*eabHmacKey, "="))
+		if err != nil {
+			log.Println("ACME_EAB_HMAC_KEY is not base64url encoded:", err)
+			return nil
+		}
+		env.eab = &acme.ExternalAccountBinding{KID: *eabKid, Key: key}
+	}
+
+	env.dnsProvider = "route53"
+	if dnsProvider := helper.Getenv("DNS_PROVIDER"); dnsProvider != nil {
+		env.dnsProvider = *dnsProvider
+	}
+	dnsProviders := map[string]bool{env.dnsProvider: true}
+	for _, config := range env.certificates {
+		if config.DNSProvider != "" {
+			dnsProviders[config.DNSProvider] = true
+		}
+	}
+	for name := range dnsProviders {
+		switch name {
+		case "route53":
+			env.awsHostedZoneId = helper.Getenv("AWS_HOSTED_ZONE_ID")
+			for name, value := range map[string]*map[string]string{
+				"AWS_DOMAIN_ROLES":      &env.awsDomainRoles,
+				"AWS_HOSTED_ZONES":      &env.awsHostedZones,
+				"AWS_HOSTED_ZONE_ROLES": &env.awsHostedZoneRoles,
+			} {
+				if str := helper.Getenv(name); str != nil {
+					if err := json.Unmarshal([]byte(*str), value); err != nil {
+						log.Println("Environment variable "+name+" is invalid:", err)
+						return nil
+					}
+				}
+			}
+			// hosted zones are discovered without the hosted zone roles, so
+			// these hosted zones must be configured
+			for hostedZoneId := range env.awsHostedZoneRoles {
+				if !knownHostedZone(env, hostedZoneId) {
+					log.Println("Environment variable AWS_HOSTED_ZONE_ROLES is invalid: hosted zone", hostedZoneId, "isn't set in AWS_HOSTED_ZONES or AWS_HOSTED_ZONE_ID")
+					return nil
+				}
+			}
+		case "cloudflare":
+			if helper.Getenv("CLOUDFLARE_API_TOKEN") == nil && helper.Getenv("CLOUDFLARE_API_TOKEN_SECRET_ARN") == nil {
+				log.Println("Environment variable CLOUDFLARE_API_TOKEN and CLOUDFLARE_API_TOKEN_SECRET_ARN not found. One of these environment variables must be set for dns provider cloudflare.")
+				return nil
+			}
+			env.cloudflareAPIURL = cloudflare.BaseURL
+			if cloudflareAPIURL := helper.Getenv("CLOUDFLARE_API_URL"); cloudflareAPIURL != nil {
+				env.cloudflareAPIURL = *cloudflareAPIURL
+			}
+		case "rfc2136":
+			if env.rfc2136Nameserver = helper.Getenv("RFC2136_NAMESERVER"); env.rfc2136Nameserver == nil {
+				log.Println("Environment variable RFC2136_NAMESERVER not found.")
+				return nil
+			}
+			if env.rfc2136TSIGKey = helper.Getenv("RFC2136_TSIG_KEY"); env.rfc2136TSIGKey == nil {
+				log.Println("Environment variable RFC2136_TSIG_KEY not found.")
+				return nil
+			}
+			if helper.Getenv("RFC2136_TSIG_SECRET") == nil && helper.Getenv("RFC2136_TSIG_SECRET_ARN") == nil {
+				log.Println("Environment variable RFC2136_TSIG_SECRET and RFC2136_TSIG_SECRET_ARN not found. One of these environment variables must be set for dns provider rfc2136.")
+				return nil
+			}
+			algorithm := ""
+			if tsigAlgorithm := helper.Getenv("RFC2136_TSIG_ALGORITHM"); tsigAlgorithm != nil {
+				algorithm = *tsigAlgorithm
+			}
+			var err error
+			if env.rfc2136TSIGAlgorithm, err = rfc2136.ParseTSIGAlgorithm(algorithm); err != nil {
+				log.Println("Environment variable RFC2136_TSIG_ALGORITHM is invalid:", err)
+				return nil
+			}
+			env.rfc2136Zone = helper.Getenv("RFC2136_ZONE")
+		default:
+			log.Println("Unknown dns provider", name)
+			return nil
+		}
+		env.dnsProviders = append(env.dnsProviders, name)
+	}
+
+	if storageBackend := helper.Getenv("STORAGE_BACKEND"); storageBackend != nil {
+		env.storageBackend = *storageBackend
+	}
+
+	env.storageDirectory = "data"
+	if storageDirectory := helper.Getenv("STORAGE_DIRECTORY"); storageDirectory != nil {
+		env.storageDirectory = *storageDirectory
+	}
+
+	env.s3Bucket = helper.Getenv("S3_BUCKET")
+	env.s3Endpoint = helper.Getenv("S3_ENDPOINT")
+	env.s3ForcePathStyle = helper.GetenvBool("S3_FORCE_PATH_STYLE")
+	if s3Prefix := helper.Getenv("S3_PREFIX"); s3Prefix != nil {
+		env.s3Prefix = *s3Prefix
+	}
+
 	if dynamodbTableName := helper.Getenv("DYNAMODB_TABLE_NAME"); dynamodbTableName != nil {
 		env.dynamodbTableName = dynamodbTableName
 	}
 
-	if issuerPassphrase := helper.Getenv("ISSUER_PASSPHRASE"); issuerPassphrase == nil {
-		if issuerPassphraseSecretsArn := helper.Getenv("ISSUER_PASSPHRASE_SECRET_ARN"); issuerPassphraseSecretsArn == nil {
-			log.Fatal("Environment variable ISSUER_PASSPHRASE and ISSUER_PASSPHRASE_SECRET_ARN not found. One of these environment variables must be set.")
+	env.dynamodbOptions = dynamodb.DefaultTableOptions()
+	env.dynamodbOptions.AutoCreate = !helper.GetenvBool("DYNAMODB_DISABLE_AUTO_CREATE")
+	if billingMode := helper.Getenv("DYNAMODB_BILLING_MODE"); billingMode != nil {
+		env.dynamodbOptions.BillingMode = strings.ToUpper(*billingMode)
+	}
+	for name, capacity := range map[string]*int64{
+		"DYNAMODB_READ_CAPACITY_UNITS":  &env.dynamodbOptions.ReadCapacityUnits,
+		"DYNAMODB_WRITE_CAPACITY_UNITS": &env.dynamodbOptions.WriteCapacityUnits,
+	} {
+		if capacityStr := helper.Getenv(name); capacityStr != nil {
+			value, err := strconv.ParseInt(*capacityStr, 10, 64)
+			if err != nil {
+				log.Println("Environment variable", name, "is invalid:", err)
+				return nil
+			}
+			*capacity = value
 		}
 	}
+	if kmsKeyId := helper.Getenv("DYNAMODB_KMS_KEY_ID"); kmsKeyId != nil {
+		env.dynamodbOptions.KMSKeyId = *kmsKeyId
+	}
+	env.dynamodbOptions.PointInTimeRecovery = helper.GetenvBool("DYNAMODB_POINT_IN_TIME_RECOVERY")
+	if tagsStr := helper.Getenv("DYNAMODB_TAGS"); tagsStr != nil {
+		if err := json.Unmarshal([]byte(*tagsStr), &env.dynamodbOptions.Tags); err != nil {
+			log.Println("Environment variable DYNAMODB_TAGS is invalid:", err)
+			return nil
+		}
+	}
+	if err := env.dynamodbOptions.Validate(); err != nil {
+		log.Println("DynamoDB table options are invalid:", err)
+		return nil
+	}
+
+	env.passphraseKDF = crypto.KDFScrypt
+	if kdf := helper.Getenv("PASSPHRASE_KDF"); kdf != nil {
+		if passphraseKDF, err := crypto.ParseKDF(*kdf); err != nil {
+			log.Println("Environment variable PASSPHRASE_KDF is invalid:", err)
+			return nil
+		} else {
+			env.passphraseKDF = passphraseKDF
+		}
+	}
+
+	env.strictEncryption = helper.GetenvBool("STRICT_ENCRYPTION")
 
-	if clientPassphrase := helper.Getenv("CLIENT_PASSPHRASE"); clientPassphrase == nil {
-		if clientPassphraseSecretsArn := helper.Getenv("CLIENT_PASSPHRASE_SECRET_ARN"); clientPassphraseSecretsArn == nil {
-			log.Fatal("Environment variable CLIENT_PASSPHRaASE and CLIENT_PASSPHRASE_SECRET_ARN not found. One of these environment variables must be set.")
+	// the passphrases are only required to decrypt existing data, if KMS is
+	// used
+	env.kmsKeyId = helper.Getenv("KMS_KEY_ID")
+	if env.kmsKeyId == nil {
+		if issuerPassphrase := helper.Getenv("ISSUER_PASSPHRASE"); issuerPassphrase == nil {
+			if issuerPassphraseSecretsArn := helper.Getenv("ISSUER_PASSPHRASE_SECRET_ARN"); issuerPassphraseSecretsArn == nil {
+				log.Fatal("Environment variable ISSUER_PASSPHRASE and ISSUER_PASSPHRASE_SECRET_ARN not found. One of these environment variables must be set.")
+			}
+		}
+
+		if clientPassphrase := helper.Getenv("CLIENT_PASSPHRASE"); clientPassphrase == nil {
+			if clientPassphraseSecretsArn := helper.Getenv("CLIENT_PASSPHRASE_SECRET_ARN"); clientPassphraseSecretsArn == nil {
+				log.Fatal("Environment variable CLIENT_PASSPHRaASE and CLIENT_PASSPHRASE_SECRET_ARN not found. One of these environment variables must be set.")
+			}
 		}
 	}
 
 	return env
 }
 
+// knownHostedZone returns true, if hostedZoneId is set in AWS_HOSTED_ZONES or
+// AWS_HOSTED_ZONE_ID
+func knownHostedZone(env *env, hostedZoneId string) bool {
+	if env.awsHostedZoneId != nil && *env.awsHostedZoneId == hostedZoneId {
+		return true
+	}
+	for _, id := range env.awsHostedZones {
+		if id == hostedZoneId {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	ActionRenew              = "renew"
+	ActionRolloverAccountKey = "rollover-account-key"
+	ActionDeactivateAccount  = "deactivate-account"
+	ActionRevokeCertificate  = "revoke-certificate"
+	ActionRotatePassphrase   = "rotate-passphrase"
+)
+
+// Event is the input of the lambda function. Scheduled events don't have an
+// action and renew the certificates.
+type Event struct {
+	Action string `json:"action"`
+
+	// revoke-certificate
+	Certificate            string `json:"certificate"`
+	Reason                 string `json:"reason"`
+	Reissue                bool   `json:"reissue"`
+	SignWithCertificateKey bool   `json:"signWithCertificateKey"`
+}
+
 func main() {
 	local := flag.Bool("local", false, "run lambda function localy")
+	event := Event{}
+	flag.StringVar(&event.Action, "action", ActionRenew, "action to run ("+strings.Join([]string{ActionRenew, ActionRolloverAccountKey, ActionDeactivateAccount, ActionRevokeCertificate, ActionRotatePassphrase}, ", ")+")")
+	flag.StringVar(&event.Certificate, "certificate", "", "name of the certificate to revoke")
+	flag.StringVar(&event.Reason, "reason", "", "RFC 5280 revocation reason (e.g. keyCompromise, superseded, cessationOfOperation)")
+	flag.BoolVar(&event.Reissue, "reissue", false, "reissue the revoked certificate")
+	flag.BoolVar(&event.SignWithCertificateKey, "sign-with-certificate-key", false, "sign the revocation request with the certificate key instead of the account key")
 	flag.Parse()
 
 	if *local {
-		if err := HandleRequest(); err != nil {
+		if err := HandleRequest(context.Background(), event); err != nil {
 			log.Fatal(err)
 		}
 	} else {
@@ -99,26 +395,257 @@ func main() {
 	}
 }
 
-func HandleRequest() error {
+func HandleRequest(ctx context.Context, event Event) error {
 	env := loadEnv()
+	if env == nil {
+		return fmt.Errorf("Configuration invalid")
+	}
+
+	crypto.SetDefaultKDF(env.passphraseKDF)
+	crypto.SetStrict(env.strictEncryption)
+	if env.kmsKeyId != nil {
+		crypto.SetDefaultKMS(crypto.NewKMS(*env.kmsKeyId))
+	} else {
+		crypto.SetDefaultKMS(nil)
+	}
 
 	// Load provider
-	route53 := route53.New(env.awsHostedZoneId)
-	p := provider.Provider(route53)
+	providers := map[string]provider.Provider{}
+	for _, name := range env.dnsProviders {
+		p, err := newProvider(name, env)
+		if err != nil {
+			return err
+		}
+		providers[name] = p
+	}
+	p := providers[env.dnsProvider]
 
-	account := account.New(env.email, env.domains, &p)
-	dynamodb := dynamodb.New(env.dynamodbTableName)
+	var httpClient *http.Client
+	if env.caBundle != nil {
+		var err error
+		if httpClient, err = account.NewHTTPClient(*env.caBundle); err != nil {
+			return err
+		}
+	}
 
-	if err := dynamodb.CreateOrLoadAccount(account); err != nil {
-		return err
+	// the ACM client is only required, if a certificate is exported
+	var exporter certificate.Exporter
+	for _, config := range env.certificates {
+		if config.ACMExport {
+			exporter = acm.New()
+			break
+		}
 	}
 
-	if err := account.CreateOrRenewCertificates(); err != nil {
-		return err
+	newAccount := func(email *string) *account.Account {
+		acc := account.New(email, env.certificates, &p)
+		acc.DirectoryURL = env.directoryURL
+		acc.HTTPClient = httpClient
+		acc.ExternalAccountBinding = env.eab
+		acc.Exporter = exporter
+		acc.Providers = providers
+		return acc
 	}
 
-	if err := dynamodb.Update(account); err != nil {
+	store, err := newStorage(env)
+	if err != nil {
 		return err
 	}
+
+	if event.Action == ActionRotatePassphrase {
+		return rotatePassphrase(event, env.email, store, newAccount)
+	}
+	return run(event, newAccount(env.email), store)
+}
+
+// rotatePassphrase encrypts every account in store again, which was
+// encrypted with the previous passphrases or format. If store can't list the
+// accounts, only the account email is rotated. Accounts are rotated
+// independently and already rotated accounts are skipped, so a failed run can
+// be repeated.
+func rotatePassphrase(event Event, email *string, store storage.Storage, newAccount func(email *string) *account.Account) error {
+	emails := []string{*email}
+	if lister, ok := store.(storage.Lister); ok {
+		var err error
+		if emails, err = lister.List(); err != nil {
+			return err
+		}
+	}
+
+	var failed []string
+	for index := range emails {
+		if err := run(event, newAccount(&emails[index]), store); err != nil {
+			log.Printf("Account %s failed: %v", emails[index], err)
+			failed = append(failed, fmt.Sprintf("%s: %v", emails[index], err))
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d accounts failed: %s", len(failed), len(emails), strings.Join(failed, "; "))
+	}
 	return nil
 }
+
+// newProvider returns the dns provider name
+func newProvider(name string, env *env) (provider.Provider, error) {
+	switch name {
+	case "route53":
+		p := route53.New(env.awsHostedZoneId)
+		for domain, hostedZoneId := range env.awsHostedZones {
+			p.HostedZones[domain] = hostedZoneId
+		}
+		for domain, role := range env.awsDomainRoles {
+			p.DomainRoles[domain] = role
+		}
+		for hostedZoneId, role := range env.awsHostedZoneRoles {
+			p.HostedZoneRoles[hostedZoneId] = role
+		}
+		return p, nil
+	case "cloudflare":
+		token := helper.Getenv("CLOUDFLARE_API_TOKEN")
+		if token == nil {
+			if tokenSecretArn := helper.Getenv("CLOUDFLARE_API_TOKEN_SECRET_ARN"); tokenSecretArn != nil {
+				token = secrets.GetSecret(tokenSecretArn)
+			}
+		}
+		if token == nil {
+			return nil, fmt.Errorf("Cloudflare api token not found.")
+		}
+		return cloudflare.NewWithClient(http.DefaultClient, env.cloudflareAPIURL, *token), nil
+	case "rfc2136":
+		secret := helper.Getenv("RFC2136_TSIG_SECRET")
+		if secret == nil {
+			if secretArn := helper.Getenv("RFC2136_TSIG_SECRET_ARN"); secretArn != nil {
+				secret = secrets.GetSecret(secretArn)
+			}
+		}
+		if secret == nil {
+			return nil, fmt.Errorf("TSIG secret not found.")
+		}
+		p, err := rfc2136.New(*env.rfc2136Nameserver, *env.rfc2136TSIGKey, env.rfc2136TSIGAlgorithm, *secret)
+		if err != nil {
+			return nil, err
+		}
+		if env.rfc2136Zone != nil {
+			p.Zone = *env.rfc2136Zone
+		}
+		return p, nil
+	default:
+		return nil, fmt.Errorf("Unknown dns provider %s", name)
+	}
+}
+
+// newStorage returns the configured storage backend
+func newStorage(env *env) (storage.Storage, error) {
+	switch env.storageBackend {
+	case "", "dynamodb":
+		return dynamodb.New(env.dynamodbTableName, env.dynamodbOptions), nil
+	case "s3":
+		if env.s3Bucket == nil {
+			return nil, fmt.Errorf("Environment variable S3_BUCKET not found.")
+		}
+		return s3.New(*env.s3Bucket, env.s3Prefix, env.s3Endpoint, env.s3ForcePathStyle), nil
+	case "file":
+		return file.New(env.storageDirectory), nil
+	default:
+		return nil, fmt.Errorf("Unknown storage backend %s", env.storageBackend)
+	}
+}
+
+// run runs the action of event for acc, the account data is loaded from and
+// saved to store
+func run(event Event, acc *account.Account, store storage.Storage) error {
+	if locker, ok := store.(storage.Locker); ok {
+		if err := locker.Lock(acc); err == storage.ErrLocked {
+			// a scheduled renewal backs off, other actions must not
+			// report success without running
+			if event.Action != "" && event.Action != ActionRenew {
+				return err
+			}
+			log.Println("Account", *acc.Email, "is locked by another run, skipping")
+			return nil
+		} else if err != nil {
+			return err
+		}
+		defer func() {
+			if err := locker.Unlock(acc); err != nil {
+				log.Println("Unlock failed:", err)
+			}
+		}()
+	}
+
+	save := func(acc *account.Account) error {
+		if !acc.Changed {
+			return nil
+		}
+		return store.Save(acc)
+	}
+
+	switch event.Action {
+	case "", ActionRenew:
+		if err := store.Load(acc); err == storage.ErrNotFound {
+			log.Println("Account not found, create account", *acc.Email)
+			if err := acc.Create(); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+
+		// store successfully renewed certificates, even if others failed
+		renewErr := acc.CreateOrRenewCertificates()
+		if err := save(acc); err != nil {
+			return err
+		}
+		return renewErr
+	case ActionRolloverAccountKey:
+		if err := store.Load(acc); err != nil {
+			return err
+		}
+
+		return acc.RolloverKey(save)
+	case ActionDeactivateAccount:
+		if err := store.Load(acc); err != nil {
+			return err
+		}
+
+		if err := acc.Deactivate(); err != nil {
+			return err
+		}
+		return save(acc)
+	case ActionRevokeCertificate:
+		reason, err := certificate.ParseReasonCode(event.Reason)
+		if err != nil {
+			return err
+		}
+
+		if err := store.Load(acc); err != nil {
+			return err
+		}
+
+		// store the revocation, even if the reissue failed
+		revokeErr := acc.RevokeCertificate(event.Certificate, reason, event.SignWithCertificateKey, event.Reissue)
+		if err := save(acc); err != nil {
+			return err
+		}
+		return revokeErr
+	case ActionRotatePassphrase:
+		if err := store.Load(acc); err == storage.ErrNotFound {
+			log.Println("Account", *acc.Email, "not found, skipping")
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		// Load marks data, which was decrypted with a previous passphrase or
+		// format, as changed
+		if !acc.Changed {
+			log.Println("Account", *acc.Email, "is already encrypted with the current passphrases")
+			return nil
+		}
+		log.Println("Encrypt account", *acc.Email, "with the current passphrases")
+		return save(acc)
+	default:
+		return fmt.Errorf("Unknown action %s", event.Action)
+	}
+}
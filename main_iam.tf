@@ -24,32 +24,157 @@ data "aws_iam_policy_document" "letsencrypt-lambda_policy" {
     effect = "Allow"
     actions = [
       "dynamodb:CreateTable",
+      "dynamodb:DeleteItem",
+      "dynamodb:DescribeTable",
+      "dynamodb:DescribeTimeToLive",
       "dynamodb:GetItem",
+      "dynamodb:PutItem",
+      "dynamodb:Scan",
+      "dynamodb:TagResource",
+      "dynamodb:UpdateContinuousBackups",
       "dynamodb:UpdateItem",
+      "dynamodb:UpdateTimeToLive",
     ]
     resources = [
       "arn:aws:dynamodb:*:*:table/${var.dynamodb_table_name}",
     ]
   }
 
-  statement {
-    effect = "Allow"
-    actions = [
-      "route53:ChangeResourceRecordSets",
-    ]
-    resources = [
-      "arn:aws:route53:::hostedzone/${var.aws_hosted_zone_id}",
-    ]
+  dynamic "statement" {
+    for_each = var.kms_key_id != "" ? [1] : []
+
+    content {
+      effect = "Allow"
+      actions = [
+        "kms:Decrypt",
+        "kms:GenerateDataKey",
+      ]
+      resources = [
+        var.kms_key_id,
+      ]
+    }
   }
 
-  statement {
-    effect = "Allow"
-    actions = [
-      "route53:GetChange",
-    ]
-    resources = [
-      "*",
-    ]
+  dynamic "statement" {
+    for_each = var.dynamodb_kms_key_id != "" ? [1] : []
+
+    content {
+      effect = "Allow"
+      actions = [
+        "kms:CreateGrant",
+        "kms:Decrypt",
+        "kms:DescribeKey",
+        "kms:Encrypt",
+      ]
+      resources = [
+        var.dynamodb_kms_key_id,
+      ]
+    }
+  }
+
+  dynamic "statement" {
+    for_each = var.storage_backend == "s3" ? [1] : []
+
+    content {
+      effect = "Allow"
+      actions = [
+        "s3:GetObject",
+        "s3:PutObject",
+      ]
+      resources = [
+        "arn:aws:s3:::${var.s3_bucket}/${var.s3_prefix}*",
+      ]
+    }
+  }
+
+  dynamic "statement" {
+    for_each = var.storage_backend == "s3" ? [1] : []
+
+    content {
+      effect = "Allow"
+      actions = [
+        "s3:ListBucket",
+      ]
+      resources = [
+        "arn:aws:s3:::${var.s3_bucket}",
+      ]
+      condition {
+        test     = "StringLike"
+        variable = "s3:prefix"
+        values = [
+          "${var.s3_prefix}*",
+        ]
+      }
+    }
+  }
+
+  dynamic "statement" {
+    for_each = local.route53_enabled ? [1] : []
+
+    content {
+      effect = "Allow"
+      actions = [
+        "route53:ChangeResourceRecordSets",
+      ]
+      resources = var.aws_hosted_zone_id != "" ? [for id in distinct(concat([var.aws_hosted_zone_id], values(var.aws_hosted_zones))) : "arn:aws:route53:::hostedzone/${id}"] : [
+        "arn:aws:route53:::hostedzone/*",
+      ]
+    }
+  }
+
+  dynamic "statement" {
+    for_each = local.route53_enabled && length(local.route53_roles) > 0 ? [1] : []
+
+    content {
+      effect = "Allow"
+      actions = [
+        "sts:AssumeRole",
+      ]
+      resources = local.route53_roles
+    }
+  }
+
+  dynamic "statement" {
+    for_each = local.route53_enabled && var.aws_hosted_zone_id == "" ? [1] : []
+
+    content {
+      effect = "Allow"
+      actions = [
+        "route53:ListHostedZonesByName",
+      ]
+      resources = [
+        "*",
+      ]
+    }
+  }
+
+  dynamic "statement" {
+    for_each = local.route53_enabled ? [1] : []
+
+    content {
+      effect = "Allow"
+      actions = [
+        "route53:GetChange",
+      ]
+      resources = [
+        "*",
+      ]
+    }
+  }
+
+  dynamic "statement" {
+    for_each = length([for c in var.certificates : c if lookup(c, "acm_export", false)]) > 0 ? [1] : []
+
+    content {
+      effect = "Allow"
+      actions = [
+        "acm:AddTagsToCertificate",
+        "acm:ImportCertificate",
+      ]
+      resources = [
+        "*",
+      ]
+    }
   }
 
   dynamic "statement" {
@@ -60,10 +185,10 @@ data "aws_iam_policy_document" "letsencrypt-lambda_policy" {
       actions = [
         "secretsmanager:GetSecretValue",
       ]
-      resources = [
+      resources = concat([
         aws_secretsmanager_secret.client_passphrase[0].arn,
         aws_secretsmanager_secret.issuer_passphrase[0].arn,
-      ]
+      ], aws_secretsmanager_secret.acme_eab_hmac_key[*].arn, aws_secretsmanager_secret.cloudflare_api_token[*].arn, aws_secretsmanager_secret.rfc2136_tsig_secret[*].arn)
     }
   }
 
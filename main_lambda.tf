@@ -15,16 +15,48 @@ resource "aws_lambda_function" "letsencrypt-lambda" {
 
   environment {
     variables = {
-      REGION                       = var.aws_region
-      ASSUME_ROLE                  = var.aws_assume_role
-      AWS_HOSTED_ZONE_ID           = var.aws_hosted_zone_id
-      CLIENT_PASSPHRASE            = var.use_aws_secrets_manager ? "" : var.client_passphrase
-      CLIENT_PASSPHRASE_SECRET_ARN = var.use_aws_secrets_manager ? aws_secretsmanager_secret.client_passphrase[0].arn : ""
-      DOMAINS                      = var.domains
-      DYNAMODB_TABLE_NAME          = var.dynamodb_table_name
-      EMAIL                        = var.email
-      ISSUER_PASSPHRASE            = var.use_aws_secrets_manager ? "" : var.issuer_passphrase
-      ISSUER_PASSPHRASE_SECRET_ARN = var.use_aws_secrets_manager ? aws_secretsmanager_secret.issuer_passphrase[0].arn : ""
+      REGION                          = var.aws_region
+      ACME_CA_BUNDLE                  = var.acme_ca_bundle
+      ACME_DIRECTORY_URL              = var.acme_directory_url
+      ACME_EAB_KID                    = var.acme_eab_kid
+      ACME_EAB_HMAC_KEY               = var.use_aws_secrets_manager ? "" : var.acme_eab_hmac_key
+      ACME_EAB_HMAC_KEY_SECRET_ARN    = var.use_aws_secrets_manager && var.acme_eab_hmac_key != "" ? aws_secretsmanager_secret.acme_eab_hmac_key[0].arn : ""
+      ASSUME_ROLE                     = var.aws_assume_role
+      AWS_DOMAIN_ROLES                = length(var.aws_domain_roles) > 0 ? jsonencode(var.aws_domain_roles) : ""
+      AWS_HOSTED_ZONE_ID              = var.aws_hosted_zone_id
+      AWS_HOSTED_ZONE_ROLES           = length(var.aws_hosted_zone_roles) > 0 ? jsonencode(var.aws_hosted_zone_roles) : ""
+      AWS_HOSTED_ZONES                = length(var.aws_hosted_zones) > 0 ? jsonencode(var.aws_hosted_zones) : ""
+      CERTIFICATES                    = length(var.certificates) > 0 ? jsonencode([for c in var.certificates : { name = c.name, domains = c.domains, keyType = c.key_type, renewBefore = c.renew_before, renewBeforeRatio = c.renew_before_ratio, disableARI = c.disable_ari, keyPolicy = c.key_policy, keyMaxAge = c.key_max_age, acmExport = c.acm_export, acmRegion = c.acm_region, dnsProvider = c.dns_provider }]) : ""
+      CLIENT_PASSPHRASE               = var.use_aws_secrets_manager ? "" : var.client_passphrase
+      CLIENT_PASSPHRASE_SECRET_ARN    = var.use_aws_secrets_manager ? aws_secretsmanager_secret.client_passphrase[0].arn : ""
+      CLOUDFLARE_API_TOKEN            = var.use_aws_secrets_manager ? "" : var.cloudflare_api_token
+      CLOUDFLARE_API_TOKEN_SECRET_ARN = var.use_aws_secrets_manager && var.cloudflare_api_token != "" ? aws_secretsmanager_secret.cloudflare_api_token[0].arn : ""
+      CLOUDFLARE_API_URL              = var.cloudflare_api_url
+      DNS_PROVIDER                    = var.dns_provider
+      DOMAINS                         = var.domains
+      DYNAMODB_BILLING_MODE           = var.dynamodb_billing_mode
+      DYNAMODB_DISABLE_AUTO_CREATE    = var.dynamodb_auto_create ? "false" : "true"
+      DYNAMODB_KMS_KEY_ID             = var.dynamodb_kms_key_id
+      DYNAMODB_POINT_IN_TIME_RECOVERY = var.dynamodb_point_in_time_recovery ? "true" : "false"
+      DYNAMODB_READ_CAPACITY_UNITS    = var.dynamodb_read_capacity_units
+      DYNAMODB_TABLE_NAME             = var.dynamodb_table_name
+      DYNAMODB_TAGS                   = length(var.dynamodb_tags) > 0 ? jsonencode(var.dynamodb_tags) : ""
+      DYNAMODB_WRITE_CAPACITY_UNITS   = var.dynamodb_write_capacity_units
+      EMAIL                           = var.email
+      ISSUER_PASSPHRASE               = var.use_aws_secrets_manager ? "" : var.issuer_passphrase
+      ISSUER_PASSPHRASE_SECRET_ARN    = var.use_aws_secrets_manager ? aws_secretsmanager_secret.issuer_passphrase[0].arn : ""
+      KMS_KEY_ID                      = var.kms_key_id
+      PASSPHRASE_KDF                  = var.passphrase_kdf
+      RFC2136_NAMESERVER              = var.rfc2136_nameserver
+      RFC2136_TSIG_ALGORITHM          = var.rfc2136_tsig_algorithm
+      RFC2136_TSIG_KEY                = var.rfc2136_tsig_key
+      RFC2136_TSIG_SECRET             = var.use_aws_secrets_manager ? "" : var.rfc2136_tsig_secret
+      RFC2136_TSIG_SECRET_ARN         = var.use_aws_secrets_manager && var.rfc2136_tsig_secret != "" ? aws_secretsmanager_secret.rfc2136_tsig_secret[0].arn : ""
+      RFC2136_ZONE                    = var.rfc2136_zone
+      S3_BUCKET                       = var.s3_bucket
+      S3_PREFIX                       = var.s3_prefix
+      STORAGE_BACKEND                 = var.storage_backend
+      STRICT_ENCRYPTION               = var.strict_encryption ? "true" : "false"
     }
   }
 }
@@ -2,4 +2,6 @@ locals {
   aws_cloudwatch_event_target_target_id = (var.aws_cloudwatch_event_target_target_id == "") ? var.aws_lambda_function_function_name : var.aws_cloudwatch_event_target_target_id
   aws_cloudwatch_event_rule_name        = (var.aws_cloudwatch_event_rule_name == "") ? var.aws_lambda_function_function_name : var.aws_cloudwatch_event_rule_name
   aws_cloudwatch_event_rule_description = (var.aws_cloudwatch_event_rule_description == "") ? var.aws_lambda_function_function_name : var.aws_cloudwatch_event_rule_description
+  route53_roles                         = distinct(concat(values(var.aws_domain_roles), values(var.aws_hosted_zone_roles)))
+  route53_enabled                       = var.dns_provider == "route53" || length([for c in var.certificates : c if lookup(c, "dns_provider", "") == "route53"]) > 0
 }
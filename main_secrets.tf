@@ -23,3 +23,42 @@ resource "aws_secretsmanager_secret_version" "issuer_passphrase" {
   secret_id     = aws_secretsmanager_secret.issuer_passphrase[0].id
   secret_string = var.issuer_passphrase
 }
+
+resource "aws_secretsmanager_secret" "acme_eab_hmac_key" {
+  count = var.use_aws_secrets_manager && var.acme_eab_hmac_key != "" ? 1 : 0
+
+  name = "${var.aws_lambda_function_function_name}-acme_eab_hmac_key"
+}
+
+resource "aws_secretsmanager_secret_version" "acme_eab_hmac_key" {
+  count = var.use_aws_secrets_manager && var.acme_eab_hmac_key != "" ? 1 : 0
+
+  secret_id     = aws_secretsmanager_secret.acme_eab_hmac_key[0].id
+  secret_string = var.acme_eab_hmac_key
+}
+
+resource "aws_secretsmanager_secret" "cloudflare_api_token" {
+  count = var.use_aws_secrets_manager && var.cloudflare_api_token != "" ? 1 : 0
+
+  name = "${var.aws_lambda_function_function_name}-cloudflare_api_token"
+}
+
+resource "aws_secretsmanager_secret_version" "cloudflare_api_token" {
+  count = var.use_aws_secrets_manager && var.cloudflare_api_token != "" ? 1 : 0
+
+  secret_id     = aws_secretsmanager_secret.cloudflare_api_token[0].id
+  secret_string = var.cloudflare_api_token
+}
+
+resource "aws_secretsmanager_secret" "rfc2136_tsig_secret" {
+  count = var.use_aws_secrets_manager && var.rfc2136_tsig_secret != "" ? 1 : 0
+
+  name = "${var.aws_lambda_function_function_name}-rfc2136_tsig_secret"
+}
+
+resource "aws_secretsmanager_secret_version" "rfc2136_tsig_secret" {
+  count = var.use_aws_secrets_manager && var.rfc2136_tsig_secret != "" ? 1 : 0
+
+  secret_id     = aws_secretsmanager_secret.rfc2136_tsig_secret[0].id
+  secret_string = var.rfc2136_tsig_secret
+}
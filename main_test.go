@@ -0,0 +1,211 @@
+/*
+Copyright 2020 Lars Eric Scheidler
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+
+	"github.com/lscheidler/letsencrypt-lambda/account"
+	"github.com/lscheidler/letsencrypt-lambda/account/certificate"
+	"github.com/lscheidler/letsencrypt-lambda/storage"
+	"github.com/lscheidler/letsencrypt-lambda/storage/memory"
+)
+
+// countingStore is a memory store, which counts the saves
+type countingStore struct {
+	*memory.Memory
+	saves int
+}
+
+func (s *countingStore) Save(acc *account.Account) error {
+	s.saves++
+	return s.Memory.Save(acc)
+}
+
+// newACMEServer returns a minimal acme server, which registers accounts
+func newACMEServer(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	mux.HandleFunc("/directory", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"newNonce":   server.URL + "/new-nonce",
+			"newAccount": server.URL + "/new-account",
+			"newOrder":   server.URL + "/new-order",
+			"revokeCert": server.URL + "/revoke-cert",
+			"keyChange":  server.URL + "/key-change",
+		})
+	})
+	mux.HandleFunc("/new-nonce", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+	})
+	mux.HandleFunc("/new-account", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+		w.Header().Set("Location", server.URL+"/account/1")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":  "valid",
+			"contact": []string{"mailto:user@example.org"},
+			"orders":  server.URL + "/account/1/orders",
+		})
+	})
+	return server
+}
+
+func TestRunCreatesAndSavesOnlyChangedAccounts(t *testing.T) {
+	os.Setenv("ISSUER_PASSPHRASE", "issuer-passphrase-0123456789abcd")
+	defer os.Unsetenv("ISSUER_PASSPHRASE")
+
+	server := newACMEServer(t)
+	store := &countingStore{Memory: memory.New()}
+	newAccount := func() *account.Account {
+		acc := account.New(aws.String("user@example.org"), nil, nil)
+		acc.ClientPassphrase = aws.String("client-passphrase-0123456789abcd")
+		acc.DirectoryURL = server.URL + "/directory"
+		return acc
+	}
+
+	if err := store.Load(newAccount()); err != storage.ErrNotFound {
+		t.Fatalf("expected %v, got %v", storage.ErrNotFound, err)
+	}
+
+	// the account is created and saved, if it isn't found
+	if err := run(Event{Action: ActionRenew}, newAccount(), store); err != nil {
+		t.Fatal(err)
+	}
+	if store.saves != 1 {
+		t.Fatalf("expected 1 save, got %d", store.saves)
+	}
+
+	acc := newAccount()
+	if err := store.Load(acc); err != nil {
+		t.Fatal(err)
+	}
+	if acc.Registration.URI != server.URL+"/account/1" {
+		t.Errorf("unexpected account uri %s", acc.Registration.URI)
+	}
+
+	// an unchanged account isn't saved again
+	if err := run(Event{Action: ActionRenew}, newAccount(), store); err != nil {
+		t.Fatal(err)
+	}
+	if store.saves != 1 {
+		t.Errorf("unchanged account was saved, %d saves", store.saves)
+	}
+
+	if err := run(Event{Action: ActionRotatePassphrase}, newAccount(), store); err != nil {
+		t.Fatal(err)
+	}
+	if store.saves != 1 {
+		t.Errorf("account with current passphrases was saved, %d saves", store.saves)
+	}
+}
+
+func TestRotatePassphrase(t *testing.T) {
+	newAccount := func(email *string) *account.Account {
+		return account.New(email, nil, nil)
+	}
+	store := &countingStore{Memory: memory.New()}
+
+	t.Setenv("ISSUER_PASSPHRASE", "issuer-a")
+	t.Setenv("CLIENT_PASSPHRASE", "client-a")
+	for _, email := range []string{"a@example.org", "b@example.org"} {
+		acc := newAccount(aws.String(email))
+		acc.Certificates["example.org"] = &certificate.Certificate{Domains: []string{"example.org"}}
+		if err := store.Memory.Save(acc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// an account, which can't be decrypted with the current or previous
+	// passphrase
+	t.Setenv("CLIENT_PASSPHRASE", "client-unknown")
+	if err := store.Memory.Save(newAccount(aws.String("broken@example.org"))); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("ISSUER_PASSPHRASE", "issuer-b")
+	t.Setenv("ISSUER_PASSPHRASE_PREVIOUS", "issuer-a")
+	t.Setenv("CLIENT_PASSPHRASE", "client-b")
+	t.Setenv("CLIENT_PASSPHRASE_PREVIOUS", "client-a")
+
+	// the failed account doesn't stop the others
+	event := Event{Action: ActionRotatePassphrase}
+	err := rotatePassphrase(event, aws.String("a@example.org"), store, newAccount)
+	if err == nil || !strings.HasPrefix(err.Error(), "1 of 3 accounts failed: broken@example.org") {
+		t.Errorf("unexpected error %v", err)
+	}
+	if store.saves != 2 {
+		t.Errorf("expected 2 saves, got %d", store.saves)
+	}
+
+	// a repeated run only retries the failed account
+	if err := rotatePassphrase(event, aws.String("a@example.org"), store, newAccount); err == nil {
+		t.Error("broken account didn't fail")
+	}
+	if store.saves != 2 {
+		t.Errorf("rotated accounts were saved again, %d saves", store.saves)
+	}
+
+	// rotated accounts are encrypted with the current passphrases
+	t.Setenv("ISSUER_PASSPHRASE_PREVIOUS", "")
+	t.Setenv("CLIENT_PASSPHRASE_PREVIOUS", "")
+	for _, email := range []string{"a@example.org", "b@example.org"} {
+		acc := newAccount(aws.String(email))
+		if err := store.Load(acc); err != nil {
+			t.Fatalf("%s: %v", email, err)
+		}
+		if acc.Changed || acc.Certificates["example.org"] == nil {
+			t.Errorf("%s: account isn't rotated (changed %v)", email, acc.Changed)
+		}
+	}
+}
+
+func TestLoadEnvHostedZoneRoles(t *testing.T) {
+	t.Setenv("EMAIL", "user@example.org")
+	t.Setenv("DOMAINS", "example.org")
+	t.Setenv("ISSUER_PASSPHRASE", "issuer-passphrase")
+	t.Setenv("CLIENT_PASSPHRASE", "client-passphrase")
+	t.Setenv("AWS_HOSTED_ZONES", `{"example.org": "ZORG"}`)
+	t.Setenv("AWS_HOSTED_ZONE_ID", "ZFIXED")
+
+	for value, valid := range map[string]bool{
+		`{"ZORG": "arn:aws:iam::111111111111:role/zone"}`:   true,
+		`{"ZFIXED": "arn:aws:iam::111111111111:role/zone"}`: true,
+		// hosted zones are discovered without role
+		`{"ZOTHER": "arn:aws:iam::111111111111:role/zone"}`: false,
+	} {
+		t.Setenv("AWS_HOSTED_ZONE_ROLES", value)
+		if env := loadEnv(); (env != nil) != valid {
+			t.Errorf("AWS_HOSTED_ZONE_ROLES %s: expected valid %v", value, valid)
+		}
+	}
+
+	t.Setenv("AWS_HOSTED_ZONE_ID", "")
+	t.Setenv("AWS_HOSTED_ZONE_ROLES", `{"ZFIXED": "arn:aws:iam::111111111111:role/zone"}`)
+	if env := loadEnv(); env != nil {
+		t.Error("AWS_HOSTED_ZONE_ROLES without AWS_HOSTED_ZONE_ID is valid")
+	}
+}
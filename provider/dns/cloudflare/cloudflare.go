@@ -0,0 +1,275 @@
+/*
+Copyright 2020 Lars Eric Scheidler
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloudflare
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// BaseURL of the Cloudflare API
+	BaseURL = "https://api.cloudflare.com/client/v4"
+
+	// DefaultPropagationTimeout is the maximum time to wait for the challenge
+	// record on the name servers of the zone. It leaves time for the
+	// validation and the order within the 5 minutes of a certificate.
+	DefaultPropagationTimeout = 2 * time.Minute
+)
+
+// Cloudflare fulfils dns-01 challenges with TXT records in Cloudflare zones.
+// The zone of a record is found by its name.
+type Cloudflare struct {
+	client  *http.Client
+	baseURL string
+	token   string
+
+	// PropagationTimeout is the maximum time to wait for the challenge record
+	// on the name servers of the zone
+	PropagationTimeout time.Duration
+	// PollInterval is the interval between propagation checks
+	PollInterval time.Duration
+
+	mutex   sync.Mutex
+	zones   map[string]*zone
+	records map[string]*record
+}
+
+type zone struct {
+	Id          string   `json:"id"`
+	Name        string   `json:"name"`
+	NameServers []string `json:"name_servers"`
+}
+
+type record struct {
+	Id      string `json:"id,omitempty"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	TTL     int    `json:"ttl"`
+
+	zone *zone
+}
+
+type response struct {
+	Success bool `json:"success"`
+	Errors  []struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+	Result json.RawMessage `json:"result"`
+}
+
+// New returns a Cloudflare provider, which authenticates with the API token
+// token. The token requires the permissions Zone:Read and DNS:Edit.
+func New(token string) *Cloudflare {
+	return NewWithClient(http.DefaultClient, BaseURL, token)
+}
+
+// NewWithClient returns a Cloudflare provider for the API at baseURL (e.g. a
+// local stand-in)
+func NewWithClient(client *http.Client, baseURL string, token string) *Cloudflare {
+	return &Cloudflare{
+		client:             client,
+		baseURL:            strings.TrimSuffix(baseURL, "/"),
+		token:              token,
+		PropagationTimeout: DefaultPropagationTimeout,
+		PollInterval:       5 * time.Second,
+		zones:              map[string]*zone{},
+		records:            map[string]*record{},
+	}
+}
+
+func (c *Cloudflare) CreateChallenge(path string, challenge string) error {
+	name := strings.TrimSuffix(path, ".")
+	z, err := c.findZone(name)
+	if err != nil {
+		return err
+	}
+
+	r := &record{
+		Type:    "TXT",
+		Name:    name,
+		Content: challenge,
+		TTL:     60,
+	}
+	var result record
+	if err := c.request(http.MethodPost, "/zones/"+z.Id+"/dns_records", r, &result); err != nil {
+		return err
+	}
+	r.Id = result.Id
+	r.zone = z
+
+	c.mutex.Lock()
+	c.records[path+challenge] = r
+	c.mutex.Unlock()
+	return nil
+}
+
+// WaitForPropagation waits until the record, created by CreateChallenge, is
+// served by all name servers of the zone
+func (c *Cloudflare) WaitForPropagation(path string, challenge string) error {
+	c.mutex.Lock()
+	r, ok := c.records[path+challenge]
+	c.mutex.Unlock()
+	if !ok {
+		return fmt.Errorf("no challenge record found for %s", path)
+	}
+
+	if len(r.zone.NameServers) == 0 {
+		log.Println("No name servers found for zone", r.zone.Name, "skip propagation check")
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.PropagationTimeout)
+	defer cancel()
+
+	for _, nameServer := range r.zone.NameServers {
+		for {
+			found, err := lookupTXT(ctx, nameServer, path, challenge)
+			if found {
+				break
+			} else if err != nil {
+				log.Println("Lookup", path, "at", nameServer, "failed:", err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("challenge record %s not found at %s: %v", path, nameServer, ctx.Err())
+			case <-time.After(c.PollInterval):
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Cloudflare) RemoveChallenge(path string, challenge string) error {
+	c.mutex.Lock()
+	r, ok := c.records[path+challenge]
+	delete(c.records, path+challenge)
+	c.mutex.Unlock()
+	if !ok {
+		return fmt.Errorf("no challenge record found for %s", path)
+	}
+
+	return c.request(http.MethodDelete, "/zones/"+r.zone.Id+"/dns_records/"+r.Id, nil, nil)
+}
+
+// findZone returns the zone of name, the zone is the longest suffix of name,
+// which is a zone of the account
+func (c *Cloudflare) findZone(name string) (*zone, error) {
+	labels := strings.Split(name, ".")
+	for index := range labels[:len(labels)-1] {
+		candidate := strings.Join(labels[index:], ".")
+
+		c.mutex.Lock()
+		z, ok := c.zones[candidate]
+		c.mutex.Unlock()
+		if ok {
+			return z, nil
+		}
+
+		var zones []zone
+		if err := c.request(http.MethodGet, "/zones?"+url.Values{"name": {candidate}}.Encode(), nil, &zones); err != nil {
+			return nil, err
+		}
+		if len(zones) > 0 {
+			z = &zones[0]
+			c.mutex.Lock()
+			c.zones[candidate] = z
+			c.mutex.Unlock()
+			return z, nil
+		}
+	}
+	return nil, fmt.Errorf("no zone found for %s", name)
+}
+
+// request sends a request with the json encoded body to the API and decodes
+// the result into result
+func (c *Cloudflare) request(method string, path string, body interface{}, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, c.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var r response
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return fmt.Errorf("%s %s: %s: %v", method, path, resp.Status, err)
+	}
+	if !r.Success || resp.StatusCode >= 300 {
+		var messages []string
+		for _, e := range r.Errors {
+			messages = append(messages, fmt.Sprintf("%d %s", e.Code, e.Message))
+		}
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.Join(messages, "; "))
+	}
+
+	if result != nil {
+		return json.Unmarshal(r.Result, result)
+	}
+	return nil
+}
+
+// lookupTXT returns true, if the name server serves the TXT record name with
+// value
+func lookupTXT(ctx context.Context, nameServer string, name string, value string) (bool, error) {
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, net.JoinHostPort(nameServer, "53"))
+		},
+	}
+
+	values, err := resolver.LookupTXT(ctx, name)
+	if err != nil {
+		return false, err
+	}
+	for _, v := range values {
+		if v == value {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,183 @@
+/*
+Copyright 2020 Lars Eric Scheidler
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloudflare
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeAPI is a httptest stand-in of the Cloudflare API with zones and dns
+// records
+type fakeAPI struct {
+	t *testing.T
+
+	mutex   sync.Mutex
+	zones   []zone
+	records map[string]record
+	// readOnly zones reject new records
+	readOnly map[string]bool
+}
+
+func newFakeAPI(t *testing.T, zones ...zone) (*fakeAPI, *httptest.Server) {
+	f := &fakeAPI{
+		t:        t,
+		zones:    zones,
+		records:  map[string]record{},
+		readOnly: map[string]bool{},
+	}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	return f, server
+}
+
+func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer token" {
+		writeResponse(w, http.StatusForbidden, nil, "9109 Invalid access token")
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == http.MethodGet && len(parts) == 1 && parts[0] == "zones":
+		result := []zone{}
+		for _, z := range f.zones {
+			if z.Name == r.URL.Query().Get("name") {
+				result = append(result, z)
+			}
+		}
+		writeResponse(w, http.StatusOK, result, "")
+	case r.Method == http.MethodPost && len(parts) == 3 && parts[2] == "dns_records":
+		if f.readOnly[parts[1]] {
+			writeResponse(w, http.StatusBadRequest, nil, "81057 Record creation is not allowed")
+			return
+		}
+		var rec record
+		if err := json.NewDecoder(r.Body).Decode(&rec); err != nil {
+			writeResponse(w, http.StatusBadRequest, nil, "1000 invalid body")
+			return
+		}
+		rec.Id = fmt.Sprintf("%s-%d", parts[1], len(f.records)+1)
+		f.records[rec.Id] = rec
+		writeResponse(w, http.StatusOK, rec, "")
+	case r.Method == http.MethodDelete && len(parts) == 4 && parts[2] == "dns_records":
+		if _, ok := f.records[parts[3]]; !ok {
+			writeResponse(w, http.StatusNotFound, nil, "81044 Record does not exist")
+			return
+		}
+		delete(f.records, parts[3])
+		writeResponse(w, http.StatusOK, map[string]string{"id": parts[3]}, "")
+	default:
+		writeResponse(w, http.StatusNotFound, nil, "7003 Could not route")
+	}
+}
+
+func writeResponse(w http.ResponseWriter, status int, result interface{}, message string) {
+	resp := map[string]interface{}{
+		"success": message == "",
+		"errors":  []interface{}{},
+		"result":  result,
+	}
+	if message != "" {
+		var code int
+		fmt.Sscanf(message, "%d", &code)
+		resp["errors"] = []interface{}{map[string]interface{}{"code": code, "message": message}}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func TestFindZoneLongestSuffix(t *testing.T) {
+	_, server := newFakeAPI(t, zone{Id: "z1", Name: "example.org"}, zone{Id: "z2", Name: "sub.example.org"})
+	c := NewWithClient(server.Client(), server.URL, "token")
+
+	for name, expected := range map[string]string{
+		"_acme-challenge.example.org":         "z1",
+		"_acme-challenge.www.example.org":     "z1",
+		"_acme-challenge.sub.example.org":     "z2",
+		"_acme-challenge.www.sub.example.org": "z2",
+	} {
+		z, err := c.findZone(name)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if z.Id != expected {
+			t.Errorf("%s: expected zone %s, got %s", name, expected, z.Id)
+		}
+	}
+
+	if _, err := c.findZone("_acme-challenge.example.net"); err == nil {
+		t.Error("zone found for unknown domain")
+	}
+}
+
+func TestCreateAndRemoveChallenge(t *testing.T) {
+	f, server := newFakeAPI(t, zone{Id: "z1", Name: "example.org"})
+	c := NewWithClient(server.Client(), server.URL, "token")
+
+	path := "_acme-challenge.www.example.org."
+	if err := c.CreateChallenge(path, "token-value"); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.records) != 1 {
+		t.Fatalf("expected 1 record, got %d", len(f.records))
+	}
+	for _, rec := range f.records {
+		if rec.Type != "TXT" || rec.Name != "_acme-challenge.www.example.org" || rec.Content != "token-value" {
+			t.Errorf("unexpected record %+v", rec)
+		}
+	}
+
+	// the zone has no name servers, so the propagation check is skipped
+	if err := c.WaitForPropagation(path, "token-value"); err != nil {
+		t.Error(err)
+	}
+
+	if err := c.RemoveChallenge(path, "token-value"); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.records) != 0 {
+		t.Errorf("record wasn't removed")
+	}
+	if err := c.RemoveChallenge(path, "token-value"); err == nil {
+		t.Error("remove of an unknown challenge succeeded")
+	}
+}
+
+func TestRequestErrors(t *testing.T) {
+	f, server := newFakeAPI(t, zone{Id: "z1", Name: "example.org"})
+	f.readOnly["z1"] = true
+
+	c := NewWithClient(server.Client(), server.URL, "token")
+	err := c.CreateChallenge("_acme-challenge.example.org.", "token-value")
+	if err == nil || !strings.Contains(err.Error(), "Record creation is not allowed") {
+		t.Errorf("expected api error, got %v", err)
+	}
+
+	c = NewWithClient(server.Client(), server.URL, "invalid")
+	if err := c.CreateChallenge("_acme-challenge.example.org.", "token-value"); err == nil {
+		t.Error("request with invalid token succeeded")
+	}
+}
@@ -0,0 +1,203 @@
+/*
+Copyright 2020 Lars Eric Scheidler
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rfc2136
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// DefaultTSIGAlgorithm is HMAC-SHA256
+	DefaultTSIGAlgorithm = dns.HmacSHA256
+
+	// DefaultPropagationTimeout is the maximum time to wait for the challenge
+	// record on the primary name server
+	DefaultPropagationTimeout = 2 * time.Minute
+)
+
+// RFC2136 fulfils dns-01 challenges with dynamic updates (RFC 2136), which
+// are signed with TSIG (RFC 8945), e.g. for BIND or Knot.
+type RFC2136 struct {
+	client     *dns.Client
+	nameserver string
+
+	// Zone of the challenge records, default is the zone found by a SOA
+	// query at the name server
+	Zone string
+	// TTL of the challenge records
+	TTL uint32
+	// PropagationTimeout is the maximum time to wait for the challenge record
+	// on the name server
+	PropagationTimeout time.Duration
+	// PollInterval is the interval between propagation checks
+	PollInterval time.Duration
+
+	tsigKey       string
+	tsigAlgorithm string
+}
+
+// ParseTSIGAlgorithm returns the TSIG algorithm for name (hmac-sha256,
+// hmac-sha512)
+func ParseTSIGAlgorithm(name string) (string, error) {
+	switch strings.ToLower(strings.TrimSuffix(name, ".")) {
+	case "", "hmac-sha256":
+		return dns.HmacSHA256, nil
+	case "hmac-sha512":
+		return dns.HmacSHA512, nil
+	default:
+		return "", fmt.Errorf("unsupported tsig algorithm %s", name)
+	}
+}
+
+// New returns a RFC2136 provider, which sends the updates to the primary name
+// server nameserver (host or host:port). The updates are signed with the TSIG
+// key tsigKey and the base64 encoded tsigSecret. The algorithm is one of
+// dns.HmacSHA256 and dns.HmacSHA512.
+func New(nameserver string, tsigKey string, tsigAlgorithm string, tsigSecret string) (*RFC2136, error) {
+	if tsigAlgorithm != dns.HmacSHA256 && tsigAlgorithm != dns.HmacSHA512 {
+		return nil, fmt.Errorf("unsupported tsig algorithm %s", tsigAlgorithm)
+	}
+	if _, _, err := net.SplitHostPort(nameserver); err != nil {
+		nameserver = net.JoinHostPort(nameserver, "53")
+	}
+
+	tsigKey = dns.Fqdn(tsigKey)
+	return &RFC2136{
+		client: &dns.Client{
+			Net:        "tcp",
+			Timeout:    10 * time.Second,
+			TsigSecret: map[string]string{tsigKey: tsigSecret},
+		},
+		nameserver:         nameserver,
+		TTL:                60,
+		PropagationTimeout: DefaultPropagationTimeout,
+		PollInterval:       2 * time.Second,
+		tsigKey:            tsigKey,
+		tsigAlgorithm:      tsigAlgorithm,
+	}, nil
+}
+
+func (r *RFC2136) CreateChallenge(path string, challenge string) error {
+	return r.update(path, challenge, false)
+}
+
+// WaitForPropagation waits until the name server serves the record, created
+// by CreateChallenge
+func (r *RFC2136) WaitForPropagation(path string, challenge string) error {
+	deadline := time.Now().Add(r.PropagationTimeout)
+	for {
+		found, err := r.lookupTXT(path, challenge)
+		if found {
+			return nil
+		} else if err != nil {
+			log.Println("Lookup", path, "at", r.nameserver, "failed:", err)
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("challenge record %s not found at %s", path, r.nameserver)
+		}
+		time.Sleep(r.PollInterval)
+	}
+}
+
+func (r *RFC2136) RemoveChallenge(path string, challenge string) error {
+	return r.update(path, challenge, true)
+}
+
+// update adds or removes the TXT record path with the value challenge
+func (r *RFC2136) update(path string, challenge string, remove bool) error {
+	zone, err := r.findZone(path)
+	if err != nil {
+		return err
+	}
+
+	rr := &dns.TXT{
+		Hdr: dns.RR_Header{
+			Name:   dns.Fqdn(path),
+			Rrtype: dns.TypeTXT,
+			Class:  dns.ClassINET,
+			Ttl:    r.TTL,
+		},
+		Txt: []string{challenge},
+	}
+
+	m := new(dns.Msg)
+	m.SetUpdate(zone)
+	if remove {
+		m.Remove([]dns.RR{rr})
+	} else {
+		m.Insert([]dns.RR{rr})
+	}
+	m.SetTsig(r.tsigKey, r.tsigAlgorithm, 300, time.Now().Unix())
+
+	in, _, err := r.client.Exchange(m, r.nameserver)
+	if err != nil {
+		return err
+	}
+	if in.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("update of %s in zone %s failed: %s", path, zone, dns.RcodeToString[in.Rcode])
+	}
+	return nil
+}
+
+// findZone returns Zone or the zone of path, which is determined by a SOA
+// query at the name server
+func (r *RFC2136) findZone(path string) (string, error) {
+	if r.Zone != "" {
+		return dns.Fqdn(r.Zone), nil
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(path), dns.TypeSOA)
+	in, _, err := r.client.Exchange(m, r.nameserver)
+	if err != nil {
+		return "", err
+	}
+
+	// the SOA is in the answer for the zone apex and in the authority section
+	// for names in the zone
+	for _, rr := range append(in.Answer, in.Ns...) {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa.Hdr.Name, nil
+		}
+	}
+	return "", fmt.Errorf("no zone found for %s at %s", path, r.nameserver)
+}
+
+// lookupTXT returns true, if the name server serves the TXT record path with
+// value
+func (r *RFC2136) lookupTXT(path string, value string) (bool, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(path), dns.TypeTXT)
+	in, _, err := r.client.Exchange(m, r.nameserver)
+	if err != nil {
+		return false, err
+	}
+
+	for _, rr := range in.Answer {
+		if txt, ok := rr.(*dns.TXT); ok && strings.Join(txt.Txt, "") == value {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,240 @@
+/*
+Copyright 2020 Lars Eric Scheidler
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rfc2136
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	testZone       = "example.org."
+	testTSIGKey    = "acme."
+	testTSIGSecret = "c2VjcmV0LWtleS1mb3ItdGVzdGluZy1vbmx5Cg=="
+)
+
+// fakeServer is an in-process primary name server for testZone, which
+// accepts TSIG signed dynamic updates
+type fakeServer struct {
+	mutex   sync.Mutex
+	records map[string][]string
+	updates []string
+}
+
+func newFakeServer(t *testing.T) (*fakeServer, string) {
+	f := &fakeServer{records: map[string][]string{}}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{})
+	server := &dns.Server{
+		Listener:   listener,
+		Net:        "tcp",
+		Handler:    f,
+		TsigSecret: map[string]string{testTSIGKey: testTSIGSecret},
+		// updates are rejected by the default accept func
+		MsgAcceptFunc: func(dh dns.Header) dns.MsgAcceptAction {
+			return dns.MsgAccept
+		},
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+
+	return f, listener.Addr().String()
+}
+
+func (f *fakeServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+
+	switch r.Opcode {
+	case dns.OpcodeUpdate:
+		tsig := r.IsTsig()
+		if tsig == nil || w.TsigStatus() != nil {
+			m.Rcode = dns.RcodeNotAuth
+			w.WriteMsg(m)
+			return
+		}
+		f.updates = append(f.updates, tsig.Algorithm)
+
+		for _, rr := range r.Ns {
+			txt, ok := rr.(*dns.TXT)
+			if !ok {
+				continue
+			}
+			value := strings.Join(txt.Txt, "")
+			name := strings.ToLower(txt.Hdr.Name)
+			switch txt.Hdr.Class {
+			case dns.ClassINET:
+				f.records[name] = append(f.records[name], value)
+			case dns.ClassNONE:
+				var values []string
+				for _, v := range f.records[name] {
+					if v != value {
+						values = append(values, v)
+					}
+				}
+				f.records[name] = values
+			}
+		}
+		m.SetTsig(tsig.Hdr.Name, tsig.Algorithm, 300, time.Now().Unix())
+	default:
+		q := r.Question[0]
+		name := strings.ToLower(q.Name)
+		if !dns.IsSubDomain(testZone, name) {
+			m.Rcode = dns.RcodeRefused
+			break
+		}
+
+		soa := &dns.SOA{
+			Hdr:     dns.RR_Header{Name: testZone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 60},
+			Ns:      "ns1." + testZone,
+			Mbox:    "hostmaster." + testZone,
+			Serial:  1,
+			Refresh: 3600,
+			Retry:   600,
+			Expire:  86400,
+			Minttl:  60,
+		}
+		switch {
+		case q.Qtype == dns.TypeSOA && name == testZone:
+			m.Answer = append(m.Answer, soa)
+		case q.Qtype == dns.TypeTXT && len(f.records[name]) > 0:
+			for _, value := range f.records[name] {
+				m.Answer = append(m.Answer, &dns.TXT{
+					Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+					Txt: []string{value},
+				})
+			}
+		default:
+			m.Ns = append(m.Ns, soa)
+		}
+	}
+	w.WriteMsg(m)
+}
+
+func (f *fakeServer) values(name string) []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.records[name]
+}
+
+func TestCreateAndRemoveChallenge(t *testing.T) {
+	for _, algorithm := range []string{dns.HmacSHA256, dns.HmacSHA512} {
+		f, addr := newFakeServer(t)
+
+		r, err := New(addr, "acme", algorithm, testTSIGSecret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.PollInterval = 10 * time.Millisecond
+
+		path := "_acme-challenge.www.example.org."
+		if err := r.CreateChallenge(path, "token-value"); err != nil {
+			t.Fatalf("%s: %v", algorithm, err)
+		}
+		if values := f.values(path); len(values) != 1 || values[0] != "token-value" {
+			t.Errorf("%s: unexpected values %v", algorithm, values)
+		}
+
+		if err := r.WaitForPropagation(path, "token-value"); err != nil {
+			t.Errorf("%s: %v", algorithm, err)
+		}
+
+		if err := r.RemoveChallenge(path, "token-value"); err != nil {
+			t.Fatalf("%s: %v", algorithm, err)
+		}
+		if values := f.values(path); len(values) != 0 {
+			t.Errorf("%s: record wasn't removed: %v", algorithm, values)
+		}
+
+		for _, used := range f.updates {
+			if used != algorithm {
+				t.Errorf("update signed with %s, expected %s", used, algorithm)
+			}
+		}
+	}
+}
+
+func TestFindZone(t *testing.T) {
+	_, addr := newFakeServer(t)
+
+	r, err := New(addr, "acme", DefaultTSIGAlgorithm, testTSIGSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"_acme-challenge.example.org.", "_acme-challenge.a.b.example.org.", "example.org."} {
+		zone, err := r.findZone(path)
+		if err != nil {
+			t.Errorf("%s: %v", path, err)
+		} else if zone != testZone {
+			t.Errorf("%s: expected zone %s, got %s", path, testZone, zone)
+		}
+	}
+
+	r.Zone = "other.example"
+	if zone, err := r.findZone("_acme-challenge.example.org."); err != nil || zone != "other.example." {
+		t.Errorf("configured zone isn't used: %s (%v)", zone, err)
+	}
+}
+
+func TestBadTSIGSecret(t *testing.T) {
+	f, addr := newFakeServer(t)
+
+	r, err := New(addr, "acme", DefaultTSIGAlgorithm, "d3Jvbmctc2VjcmV0Cg==")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = r.CreateChallenge("_acme-challenge.example.org.", "token-value")
+	if err == nil || !strings.Contains(err.Error(), "NOTAUTH") {
+		t.Errorf("expected NOTAUTH, got %v", err)
+	}
+	if values := f.values("_acme-challenge.example.org."); len(values) != 0 {
+		t.Errorf("record was added: %v", values)
+	}
+}
+
+func TestParseTSIGAlgorithm(t *testing.T) {
+	for name, expected := range map[string]string{
+		"":            dns.HmacSHA256,
+		"hmac-sha256": dns.HmacSHA256,
+		"HMAC-SHA512": dns.HmacSHA512,
+	} {
+		if algorithm, err := ParseTSIGAlgorithm(name); err != nil || algorithm != expected {
+			t.Errorf("%s: expected %s, got %s (%v)", name, expected, algorithm, err)
+		}
+	}
+
+	if _, err := ParseTSIGAlgorithm("hmac-md5"); err == nil {
+		t.Error("unsupported algorithm accepted")
+	}
+}
@@ -17,91 +17,431 @@ limitations under the License.
 package route53
 
 import (
+	"fmt"
 	"log"
+	"strings"
+	"sync"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/aws/aws-sdk-go/service/route53/route53iface"
 
 	awshelper "github.com/lscheidler/letsencrypt-lambda/helper/aws"
+	"github.com/lscheidler/letsencrypt-lambda/provider"
 )
 
 type Route53 struct {
-	svc          *route53.Route53
+	svc          route53iface.Route53API
 	hostedZoneId *string
+	newClient    func(role string) route53iface.Route53API
+
+	// HostedZones maps domains to hosted zone ids. The hosted zone of the
+	// longest matching domain is used instead of a discovered hosted zone.
+	HostedZones map[string]string
+	// DomainRoles maps domains to role arns. The role of the longest matching
+	// domain is assumed to discover the hosted zone and to change records.
+	DomainRoles map[string]string
+	// HostedZoneRoles maps hosted zone ids to role arns, which are assumed to
+	// change records in the hosted zone. It takes precedence over DomainRoles.
+	// Hosted zones are discovered without these roles.
+	HostedZoneRoles map[string]string
+
+	mutex   sync.Mutex
+	clients map[string]route53iface.Route53API
+	changes map[string]*change
+	zones   map[string]string
 }
 
-func New(hostedZoneId *string) *Route53 {
-	result := Route53{hostedZoneId: hostedZoneId}
+type change struct {
+	id  *string
+	svc route53iface.Route53API
+}
 
-	sess, conf := awshelper.GetAwsSession()
-	result.svc = route53.New(sess, conf)
+// batch contains the challenge records of one hosted zone, grouped by path
+type batch struct {
+	svc          route53iface.Route53API
+	hostedZoneId string
+	paths        []string
+	values       map[string][]string
+}
 
-	return &result
+// New returns a Route53 provider. If hostedZoneId is nil, the hosted zone of
+// each challenge record is discovered with ListHostedZonesByName.
+func New(hostedZoneId *string) *Route53 {
+	sess, conf := awshelper.GetAwsSession()
+	r := NewWithClient(route53.New(sess, conf), hostedZoneId)
+	r.newClient = func(role string) route53iface.Route53API {
+		sess, conf := awshelper.GetAwsSessionWithRole(role)
+		return route53.New(sess, conf)
+	}
+	return r
 }
 
-func (r *Route53) CreateChallenge(path string, challenge string) {
-	input := &route53.ChangeResourceRecordSetsInput{
-		ChangeBatch: &route53.ChangeBatch{
-			Changes: []*route53.Change{
-				{
-					Action: aws.String("UPSERT"),
-					ResourceRecordSet: &route53.ResourceRecordSet{
-						Name: aws.String(path),
-						ResourceRecords: []*route53.ResourceRecord{
-							{
-								Value: aws.String(`"` + challenge + `"`),
-							},
-						},
-						TTL:  aws.Int64(60),
-						Type: aws.String("TXT"),
-					},
-				},
-			},
-			Comment: aws.String("ACME challenge"),
+// NewWithClient returns a Route53 provider, which uses svc for api calls.
+// svc is used for all roles.
+func NewWithClient(svc route53iface.Route53API, hostedZoneId *string) *Route53 {
+	return &Route53{
+		svc:          svc,
+		hostedZoneId: hostedZoneId,
+		newClient: func(role string) route53iface.Route53API {
+			return svc
 		},
-		HostedZoneId: r.hostedZoneId,
+		HostedZones:     map[string]string{},
+		DomainRoles:     map[string]string{},
+		HostedZoneRoles: map[string]string{},
+		clients:         map[string]route53iface.Route53API{},
+		changes:         map[string]*change{},
+		zones:           map[string]string{},
 	}
+}
 
-	result, err := r.svc.ChangeResourceRecordSets(input)
+func (r *Route53) CreateChallenge(path string, challenge string) error {
+	c, err := r.changeChallenge("UPSERT", path, challenge)
 	if err != nil {
-		printError(err)
-		return
+		return err
 	}
 
-	r.svc.WaitUntilResourceRecordSetsChanged(&route53.GetChangeInput{Id: result.ChangeInfo.Id})
+	r.mutex.Lock()
+	r.changes[path+challenge] = c
+	r.mutex.Unlock()
+	return nil
 }
 
-func (r *Route53) RemoveChallenge(path string, challenge string) {
+// WaitForPropagation waits until the change, submitted by CreateChallenge, is
+// INSYNC on all route53 dns servers
+func (r *Route53) WaitForPropagation(path string, challenge string) error {
+	r.mutex.Lock()
+	c, ok := r.changes[path+challenge]
+	delete(r.changes, path+challenge)
+	r.mutex.Unlock()
+	if !ok {
+		return fmt.Errorf("no pending change found for %s", path)
+	}
+
+	return c.svc.WaitUntilResourceRecordSetsChanged(&route53.GetChangeInput{Id: c.id})
+}
+
+func (r *Route53) RemoveChallenge(path string, challenge string) error {
+	c, err := r.changeChallenge("DELETE", path, challenge)
+	if err != nil {
+		return err
+	}
+
+	return c.svc.WaitUntilResourceRecordSetsChanged(&route53.GetChangeInput{Id: c.id})
+}
+
+// CreateChallenges publishes all challenge records with one change per
+// hosted zone
+func (r *Route53) CreateChallenges(challenges []provider.Challenge) error {
+	batches, err := r.batches(challenges)
+	if err != nil {
+		return err
+	}
+
+	changes := map[*batch]*change{}
+	for _, b := range batches {
+		c, err := r.changeBatch("UPSERT", b)
+		if err != nil {
+			for created := range changes {
+				if _, err := r.changeBatch("DELETE", created); err != nil {
+					log.Println("Remove challenge records in", created.hostedZoneId, "failed:", err)
+				}
+			}
+			return err
+		}
+		changes[b] = c
+	}
+
+	r.mutex.Lock()
+	for b, c := range changes {
+		for path, values := range b.values {
+			for _, value := range values {
+				r.changes[path+value] = c
+			}
+		}
+	}
+	r.mutex.Unlock()
+	return nil
+}
+
+// WaitForChallenges waits until the changes, submitted by CreateChallenges,
+// are INSYNC on all route53 dns servers
+func (r *Route53) WaitForChallenges(challenges []provider.Challenge) error {
+	var changes []*change
+	r.mutex.Lock()
+	for _, challenge := range challenges {
+		c, ok := r.changes[challenge.Path+challenge.Value]
+		delete(r.changes, challenge.Path+challenge.Value)
+		if !ok {
+			r.mutex.Unlock()
+			return fmt.Errorf("no pending change found for %s", challenge.Path)
+		}
+		if !containsChange(changes, c) {
+			changes = append(changes, c)
+		}
+	}
+	r.mutex.Unlock()
+
+	for _, c := range changes {
+		if err := c.svc.WaitUntilResourceRecordSetsChanged(&route53.GetChangeInput{Id: c.id}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveChallenges removes all challenge records with one change per hosted
+// zone
+func (r *Route53) RemoveChallenges(challenges []provider.Challenge) error {
+	batches, err := r.batches(challenges)
+	if err != nil {
+		return err
+	}
+
+	var changes []*change
+	for _, b := range batches {
+		c, err := r.changeBatch("DELETE", b)
+		if err != nil {
+			return err
+		}
+		changes = append(changes, c)
+	}
+
+	for _, c := range changes {
+		if err := c.svc.WaitUntilResourceRecordSetsChanged(&route53.GetChangeInput{Id: c.id}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Route53) changeChallenge(action string, path string, challenge string) (*change, error) {
+	batches, err := r.batches([]provider.Challenge{{Path: path, Value: challenge}})
+	if err != nil {
+		return nil, err
+	}
+
+	return r.changeBatch(action, batches[0])
+}
+
+// changeBatch submits one change for all challenge records of b. Values with
+// the same path are one TXT record set.
+func (r *Route53) changeBatch(action string, b *batch) (*change, error) {
 	input := &route53.ChangeResourceRecordSetsInput{
 		ChangeBatch: &route53.ChangeBatch{
-			Changes: []*route53.Change{
-				{
-					Action: aws.String("DELETE"),
-					ResourceRecordSet: &route53.ResourceRecordSet{
-						Name: aws.String(path),
-						ResourceRecords: []*route53.ResourceRecord{
-							{
-								Value: aws.String(`"` + challenge + `"`),
-							},
-						},
-						TTL:  aws.Int64(60),
-						Type: aws.String("TXT"),
-					},
-				},
-			},
 			Comment: aws.String("ACME challenge"),
 		},
-		HostedZoneId: r.hostedZoneId,
+		HostedZoneId: aws.String(b.hostedZoneId),
+	}
+	for _, path := range b.paths {
+		var records []*route53.ResourceRecord
+		for _, value := range b.values[path] {
+			records = append(records, &route53.ResourceRecord{
+				Value: aws.String(`"` + value + `"`),
+			})
+		}
+		input.ChangeBatch.Changes = append(input.ChangeBatch.Changes, &route53.Change{
+			Action: aws.String(action),
+			ResourceRecordSet: &route53.ResourceRecordSet{
+				Name:            aws.String(path),
+				ResourceRecords: records,
+				TTL:             aws.Int64(60),
+				Type:            aws.String("TXT"),
+			},
+		})
 	}
 
-	result, err := r.svc.ChangeResourceRecordSets(input)
+	result, err := b.svc.ChangeResourceRecordSets(input)
 	if err != nil {
 		printError(err)
-		return
+		return nil, err
+	}
+
+	return &change{id: result.ChangeInfo.Id, svc: b.svc}, nil
+}
+
+// batches groups challenges by hosted zone and path
+func (r *Route53) batches(challenges []provider.Challenge) ([]*batch, error) {
+	type key struct {
+		svc          route53iface.Route53API
+		hostedZoneId string
+	}
+
+	var result []*batch
+	batches := map[key]*batch{}
+	for _, challenge := range challenges {
+		svc, hostedZoneId, err := r.route(challenge.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		b, ok := batches[key{svc, hostedZoneId}]
+		if !ok {
+			b = &batch{
+				svc:          svc,
+				hostedZoneId: hostedZoneId,
+				values:       map[string][]string{},
+			}
+			batches[key{svc, hostedZoneId}] = b
+			result = append(result, b)
+		}
+
+		values, ok := b.values[challenge.Path]
+		if !ok {
+			b.paths = append(b.paths, challenge.Path)
+		}
+		if !containsString(values, challenge.Value) {
+			b.values[challenge.Path] = append(values, challenge.Value)
+		}
+	}
+	return result, nil
+}
+
+// route returns the hosted zone id for the record path and the client, which
+// changes records in this hosted zone
+func (r *Route53) route(path string) (route53iface.Route53API, string, error) {
+	name := strings.ToLower(strings.TrimSuffix(path, "."))
+
+	role, _ := matchDomain(r.DomainRoles, name)
+	hostedZoneId, err := r.findHostedZone(role, name)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if zoneRole, ok := r.HostedZoneRoles[hostedZoneId]; ok {
+		role = zoneRole
+	}
+	return r.client(role), hostedZoneId, nil
+}
+
+// client returns the client for role, the client without role is returned
+// for an empty role
+func (r *Route53) client(role string) route53iface.Route53API {
+	if role == "" {
+		return r.svc
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	svc, ok := r.clients[role]
+	if !ok {
+		svc = r.newClient(role)
+		r.clients[role] = svc
+	}
+	return svc
+}
+
+// findHostedZone returns the hosted zone id for the record name. The hosted
+// zone is taken from HostedZones, the fixed hosted zone or is the public
+// hosted zone with the longest suffix of name, which is discovered with role.
+func (r *Route53) findHostedZone(role string, name string) (string, error) {
+	if hostedZoneId, ok := matchDomain(r.HostedZones, name); ok {
+		return hostedZoneId, nil
 	}
 
-	r.svc.WaitUntilResourceRecordSetsChanged(&route53.GetChangeInput{Id: result.ChangeInfo.Id})
+	if r.hostedZoneId != nil {
+		return *r.hostedZoneId, nil
+	}
+
+	labels := strings.Split(name, ".")
+	for index := range labels[:len(labels)-1] {
+		candidate := strings.Join(labels[index:], ".")
+
+		r.mutex.Lock()
+		hostedZoneId, ok := r.zones[role+"|"+candidate]
+		r.mutex.Unlock()
+		if !ok {
+			var err error
+			if hostedZoneId, err = r.lookupHostedZone(r.client(role), candidate); err != nil {
+				return "", err
+			}
+			r.mutex.Lock()
+			r.zones[role+"|"+candidate] = hostedZoneId
+			r.mutex.Unlock()
+		}
+		if hostedZoneId != "" {
+			return hostedZoneId, nil
+		}
+	}
+	return "", fmt.Errorf("no public hosted zone found for %s", name)
+}
+
+// lookupHostedZone returns the id of the public hosted zone named name or an
+// empty string, if there is no such hosted zone. Private hosted zones are
+// skipped, because the acme server can't resolve their records.
+func (r *Route53) lookupHostedZone(svc route53iface.Route53API, name string) (string, error) {
+	var found []string
+	input := &route53.ListHostedZonesByNameInput{
+		DNSName:  aws.String(name),
+		MaxItems: aws.String("100"),
+	}
+	for {
+		result, err := svc.ListHostedZonesByName(input)
+		if err != nil {
+			printError(err)
+			return "", err
+		}
+
+		for _, zone := range result.HostedZones {
+			if strings.ToLower(strings.TrimSuffix(aws.StringValue(zone.Name), ".")) != name {
+				continue
+			}
+			if zone.Config != nil && aws.BoolValue(zone.Config.PrivateZone) {
+				log.Println("Skip private hosted zone", aws.StringValue(zone.Id), "for", name)
+				continue
+			}
+			found = append(found, strings.TrimPrefix(aws.StringValue(zone.Id), "/hostedzone/"))
+		}
+
+		if !aws.BoolValue(result.IsTruncated) || strings.ToLower(strings.TrimSuffix(aws.StringValue(result.NextDNSName), ".")) != name {
+			break
+		}
+		input.DNSName = result.NextDNSName
+		input.HostedZoneId = result.NextHostedZoneId
+	}
+
+	switch len(found) {
+	case 0:
+		return "", nil
+	case 1:
+		return found[0], nil
+	default:
+		return "", fmt.Errorf("multiple public hosted zones found for %s (%s), set the hosted zone in HostedZones", name, strings.Join(found, ", "))
+	}
+}
+
+// matchDomain returns the value of the longest domain in domains, which is a
+// suffix of name
+func matchDomain(domains map[string]string, name string) (string, bool) {
+	labels := strings.Split(name, ".")
+	for index := range labels {
+		candidate := strings.Join(labels[index:], ".")
+		for domain, value := range domains {
+			if strings.ToLower(strings.TrimSuffix(domain, ".")) == candidate {
+				return value, true
+			}
+		}
+	}
+	return "", false
+}
+
+func containsChange(changes []*change, c *change) bool {
+	for _, item := range changes {
+		if item == c {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, item := range values {
+		if item == value {
+			return true
+		}
+	}
+	return false
 }
 
 func printError(err error) {
@@ -0,0 +1,460 @@
+/*
+Copyright 2020 Lars Eric Scheidler
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package route53
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/aws/aws-sdk-go/service/route53/route53iface"
+
+	"github.com/lscheidler/letsencrypt-lambda/provider"
+)
+
+// fakeRoute53 is an in-memory stand-in of the route53 api with hosted zones,
+// which are listed in pages of pageSize zones. Clients of different roles
+// share the hosted zones and the calls.
+type fakeRoute53 struct {
+	route53iface.Route53API
+	*backend
+
+	role string
+}
+
+type backend struct {
+	zones    []*route53.HostedZone
+	pageSize int
+	lists    []string
+	calls    []call
+	changes  []*route53.ChangeResourceRecordSetsInput
+	// failZones reject changes with action
+	failZones map[string]string
+}
+
+// call is an api call with the role of the client
+type call struct {
+	role      string
+	operation string
+}
+
+func newFakeRoute53(zones ...*route53.HostedZone) *fakeRoute53 {
+	sort.SliceStable(zones, func(i, j int) bool {
+		return aws.StringValue(zones[i].Name) < aws.StringValue(zones[j].Name)
+	})
+	return &fakeRoute53{backend: &backend{zones: zones, pageSize: 100, failZones: map[string]string{}}}
+}
+
+// newProvider returns a provider, which uses svc for the default and all
+// assumed roles
+func newProvider(svc *fakeRoute53, hostedZoneId *string) (*Route53, *[]string) {
+	var roles []string
+	r := NewWithClient(svc, hostedZoneId)
+	r.newClient = func(role string) route53iface.Route53API {
+		roles = append(roles, role)
+		return &fakeRoute53{backend: svc.backend, role: role}
+	}
+	return r, &roles
+}
+
+func hostedZone(id string, name string, private bool) *route53.HostedZone {
+	return &route53.HostedZone{
+		Config: &route53.HostedZoneConfig{PrivateZone: aws.Bool(private)},
+		Id:     aws.String("/hostedzone/" + id),
+		Name:   aws.String(name + "."),
+	}
+}
+
+func (f *fakeRoute53) ListHostedZonesByName(input *route53.ListHostedZonesByNameInput) (*route53.ListHostedZonesByNameOutput, error) {
+	f.calls = append(f.calls, call{f.role, "ListHostedZonesByName"})
+	f.lists = append(f.lists, aws.StringValue(input.DNSName))
+
+	start := len(f.zones)
+	for index, zone := range f.zones {
+		name := strings.TrimSuffix(aws.StringValue(zone.Name), ".")
+		if name < strings.TrimSuffix(aws.StringValue(input.DNSName), ".") {
+			continue
+		}
+		if input.HostedZoneId != nil && aws.StringValue(zone.Id) != "/hostedzone/"+aws.StringValue(input.HostedZoneId) {
+			continue
+		}
+		start = index
+		break
+	}
+
+	end := start + f.pageSize
+	if end >= len(f.zones) {
+		return &route53.ListHostedZonesByNameOutput{
+			HostedZones: f.zones[start:],
+			IsTruncated: aws.Bool(false),
+		}, nil
+	}
+	return &route53.ListHostedZonesByNameOutput{
+		HostedZones:      f.zones[start:end],
+		IsTruncated:      aws.Bool(true),
+		NextDNSName:      f.zones[end].Name,
+		NextHostedZoneId: aws.String(strings.TrimPrefix(aws.StringValue(f.zones[end].Id), "/hostedzone/")),
+	}, nil
+}
+
+func (f *fakeRoute53) ChangeResourceRecordSets(input *route53.ChangeResourceRecordSetsInput) (*route53.ChangeResourceRecordSetsOutput, error) {
+	f.calls = append(f.calls, call{f.role, "ChangeResourceRecordSets"})
+	if action, ok := f.failZones[aws.StringValue(input.HostedZoneId)]; ok && action == aws.StringValue(input.ChangeBatch.Changes[0].Action) {
+		return nil, awserr.New(route53.ErrCodeInvalidChangeBatch, "change rejected", nil)
+	}
+	f.changes = append(f.changes, input)
+	return &route53.ChangeResourceRecordSetsOutput{
+		ChangeInfo: &route53.ChangeInfo{Id: aws.String(fmt.Sprintf("/change/C%d", len(f.changes)))},
+	}, nil
+}
+
+func (f *fakeRoute53) WaitUntilResourceRecordSetsChanged(input *route53.GetChangeInput) error {
+	f.calls = append(f.calls, call{f.role, "GetChange"})
+	return nil
+}
+
+func TestRouteLongestSuffix(t *testing.T) {
+	svc := newFakeRoute53(
+		hostedZone("ZORG", "example.org", false),
+		hostedZone("ZSUB", "sub.example.org", false),
+		hostedZone("ZCOM", "example.com", false),
+	)
+	r := NewWithClient(svc, nil)
+
+	for path, expected := range map[string]string{
+		"_acme-challenge.www.sub.example.org.": "ZSUB",
+		"_acme-challenge.sub.example.org":      "ZSUB",
+		"_acme-challenge.www.example.org.":     "ZORG",
+		"_acme-challenge.Example.COM.":         "ZCOM",
+	} {
+		_, hostedZoneId, err := r.route(path)
+		if err != nil {
+			t.Fatalf("route %s failed: %v", path, err)
+		}
+		if hostedZoneId != expected {
+			t.Errorf("route %s = %s, expected %s", path, hostedZoneId, expected)
+		}
+	}
+
+	if _, _, err := r.route("_acme-challenge.example.net."); err == nil || !strings.Contains(err.Error(), "no public hosted zone found") {
+		t.Errorf("route without hosted zone returned %v", err)
+	}
+}
+
+func TestRouteSkipsPrivateZones(t *testing.T) {
+	svc := newFakeRoute53(
+		hostedZone("ZPRIVATE", "example.org", true),
+		hostedZone("ZPUBLIC", "example.org", false),
+		hostedZone("ZINTERNAL", "internal.example.org", true),
+	)
+	r := NewWithClient(svc, nil)
+
+	_, hostedZoneId, err := r.route("_acme-challenge.example.org.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hostedZoneId != "ZPUBLIC" {
+		t.Errorf("expected public hosted zone ZPUBLIC, got %s", hostedZoneId)
+	}
+
+	// the private internal.example.org zone is skipped for the parent zone
+	_, hostedZoneId, err = r.route("_acme-challenge.internal.example.org.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hostedZoneId != "ZPUBLIC" {
+		t.Errorf("expected parent hosted zone ZPUBLIC, got %s", hostedZoneId)
+	}
+}
+
+func TestRouteMultiplePublicZones(t *testing.T) {
+	svc := newFakeRoute53(
+		hostedZone("ZONE1", "example.org", false),
+		hostedZone("ZONE2", "example.org", false),
+	)
+	r := NewWithClient(svc, nil)
+
+	_, _, err := r.route("_acme-challenge.example.org.")
+	if err == nil || !strings.Contains(err.Error(), "multiple public hosted zones found for example.org (ZONE1, ZONE2)") {
+		t.Fatalf("expected multiple public hosted zones error, got %v", err)
+	}
+
+	// an explicit hosted zone resolves the ambiguity
+	r.HostedZones["example.org"] = "ZONE2"
+	if _, hostedZoneId, err := r.route("_acme-challenge.example.org."); err != nil || hostedZoneId != "ZONE2" {
+		t.Errorf("route = %s, %v, expected ZONE2", hostedZoneId, err)
+	}
+}
+
+func TestRoutePagination(t *testing.T) {
+	svc := newFakeRoute53(
+		hostedZone("ZPRIVATE1", "example.org", true),
+		hostedZone("ZPRIVATE2", "example.org", true),
+		hostedZone("ZPUBLIC", "example.org", false),
+		hostedZone("ZOTHER", "other.example.org", false),
+	)
+	svc.pageSize = 1
+	r := NewWithClient(svc, nil)
+
+	_, hostedZoneId, err := r.route("_acme-challenge.example.org.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hostedZoneId != "ZPUBLIC" {
+		t.Errorf("expected ZPUBLIC from the third page, got %s", hostedZoneId)
+	}
+
+	// the lookup stops with the first zone of another name
+	expected := []string{"_acme-challenge.example.org", "example.org", "example.org.", "example.org."}
+	if strings.Join(svc.lists, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected lists %v, got %v", expected, svc.lists)
+	}
+}
+
+func TestRouteCachesHostedZones(t *testing.T) {
+	svc := newFakeRoute53(hostedZone("ZORG", "example.org", false))
+	r := NewWithClient(svc, nil)
+
+	if _, _, err := r.route("_acme-challenge.www.example.org."); err != nil {
+		t.Fatal(err)
+	}
+	calls := len(svc.lists)
+	if calls != 3 {
+		t.Fatalf("expected 3 lookups, got %v", svc.lists)
+	}
+
+	// known candidates, including the ones without hosted zone, are cached
+	for _, path := range []string{"_acme-challenge.www.example.org.", "_acme-challenge.www.example.org", "www.example.org"} {
+		if _, hostedZoneId, err := r.route(path); err != nil || hostedZoneId != "ZORG" {
+			t.Fatalf("route %s = %s, %v", path, hostedZoneId, err)
+		}
+	}
+	if len(svc.lists) != calls {
+		t.Errorf("expected cached hosted zones, got lookups %v", svc.lists[calls:])
+	}
+
+	// a new provider, e.g. of the next run, discovers the hosted zone again
+	if _, _, err := NewWithClient(svc, nil).route("_acme-challenge.example.org."); err != nil {
+		t.Fatal(err)
+	}
+	if len(svc.lists) == calls {
+		t.Errorf("expected a lookup with a new provider")
+	}
+}
+
+func TestRouteWithoutDiscovery(t *testing.T) {
+	svc := newFakeRoute53(hostedZone("ZORG", "example.org", false))
+
+	r := NewWithClient(svc, aws.String("ZFIXED"))
+	if _, hostedZoneId, err := r.route("_acme-challenge.example.org."); err != nil || hostedZoneId != "ZFIXED" {
+		t.Errorf("route = %s, %v, expected ZFIXED", hostedZoneId, err)
+	}
+
+	r = NewWithClient(svc, nil)
+	r.HostedZones["example.org."] = "ZCONFIGURED"
+	if _, hostedZoneId, err := r.route("_acme-challenge.www.example.org."); err != nil || hostedZoneId != "ZCONFIGURED" {
+		t.Errorf("route = %s, %v, expected ZCONFIGURED", hostedZoneId, err)
+	}
+
+	if len(svc.lists) != 0 {
+		t.Errorf("expected no lookups, got %v", svc.lists)
+	}
+}
+
+func TestRoles(t *testing.T) {
+	svc := newFakeRoute53(
+		hostedZone("ZORG", "example.org", false),
+		hostedZone("ZCOM", "example.com", false),
+		hostedZone("ZNET", "example.net", false),
+	)
+	r, roles := newProvider(svc, nil)
+	r.DomainRoles["example.org"] = "arn:aws:iam::111111111111:role/domain"
+	r.HostedZones["example.com"] = "ZCOM"
+	r.HostedZoneRoles["ZCOM"] = "arn:aws:iam::222222222222:role/zone"
+
+	challenges := []provider.Challenge{
+		{Path: "_acme-challenge.www.example.org.", Value: "a"},
+		{Path: "_acme-challenge.www.example.com.", Value: "b"},
+		{Path: "_acme-challenge.example.net.", Value: "c"},
+	}
+	if err := r.CreateChallenges(challenges); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.WaitForChallenges(challenges); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []call{
+		// the domain role discovers and changes the hosted zone
+		{"arn:aws:iam::111111111111:role/domain", "ListHostedZonesByName"},
+		{"arn:aws:iam::111111111111:role/domain", "ListHostedZonesByName"},
+		{"arn:aws:iam::111111111111:role/domain", "ListHostedZonesByName"},
+		// the hosted zone with role isn't discovered, the hosted zone without
+		// role is discovered and changed without an assumed role
+		{"", "ListHostedZonesByName"},
+		{"", "ListHostedZonesByName"},
+		{"arn:aws:iam::111111111111:role/domain", "ChangeResourceRecordSets"},
+		{"arn:aws:iam::222222222222:role/zone", "ChangeResourceRecordSets"},
+		{"", "ChangeResourceRecordSets"},
+		{"arn:aws:iam::111111111111:role/domain", "GetChange"},
+		{"arn:aws:iam::222222222222:role/zone", "GetChange"},
+		{"", "GetChange"},
+	}
+	if fmt.Sprint(svc.calls) != fmt.Sprint(expected) {
+		t.Errorf("expected calls\n%v\ngot\n%v", expected, svc.calls)
+	}
+
+	// each role is assumed once
+	if strings.Join(*roles, ",") != "arn:aws:iam::111111111111:role/domain,arn:aws:iam::222222222222:role/zone" {
+		t.Errorf("unexpected assumed roles %v", *roles)
+	}
+}
+
+// records returns the actions, names and values of the changes in zone
+func records(changes []*route53.ChangeResourceRecordSetsInput, zone string) []string {
+	var result []string
+	for _, input := range changes {
+		if aws.StringValue(input.HostedZoneId) != zone {
+			continue
+		}
+		for _, c := range input.ChangeBatch.Changes {
+			var values []string
+			for _, record := range c.ResourceRecordSet.ResourceRecords {
+				values = append(values, aws.StringValue(record.Value))
+			}
+			result = append(result, fmt.Sprintf("%s %s %s", aws.StringValue(c.Action), aws.StringValue(c.ResourceRecordSet.Name), strings.Join(values, ",")))
+		}
+	}
+	return result
+}
+
+func TestCreateChallengesWildcardAndApex(t *testing.T) {
+	svc := newFakeRoute53(hostedZone("ZORG", "example.org", false))
+	r, _ := newProvider(svc, nil)
+
+	// *.example.org and example.org have the same challenge record path
+	challenges := []provider.Challenge{
+		{Path: "_acme-challenge.example.org.", Value: "wildcard"},
+		{Path: "_acme-challenge.example.org.", Value: "apex"},
+		{Path: "_acme-challenge.www.example.org.", Value: "www"},
+	}
+	if err := r.CreateChallenges(challenges); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(svc.changes) != 1 {
+		t.Fatalf("expected 1 change, got %d", len(svc.changes))
+	}
+	expected := []string{
+		`UPSERT _acme-challenge.example.org. "wildcard","apex"`,
+		`UPSERT _acme-challenge.www.example.org. "www"`,
+	}
+	if got := records(svc.changes, "ZORG"); strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected records %v, got %v", expected, got)
+	}
+
+	if err := r.WaitForChallenges(challenges); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.RemoveChallenges(challenges); err != nil {
+		t.Fatal(err)
+	}
+	if got := records(svc.changes[1:], "ZORG"); len(got) != 2 || got[0] != `DELETE _acme-challenge.example.org. "wildcard","apex"` {
+		t.Errorf("unexpected removed records %v", got)
+	}
+}
+
+func TestCreateChallengesPerHostedZoneAndRole(t *testing.T) {
+	svc := newFakeRoute53(
+		hostedZone("ZORG", "example.org", false),
+		hostedZone("ZCOM", "example.com", false),
+	)
+	r, _ := newProvider(svc, nil)
+	r.HostedZones["shared.example.net"] = "ZNET"
+	r.HostedZones["other.example.net"] = "ZNET"
+	r.DomainRoles["other.example.net"] = "arn:aws:iam::111111111111:role/other"
+
+	challenges := []provider.Challenge{
+		{Path: "_acme-challenge.example.org.", Value: "org"},
+		{Path: "_acme-challenge.example.com.", Value: "com"},
+		{Path: "_acme-challenge.www.example.org.", Value: "www"},
+		{Path: "_acme-challenge.shared.example.net.", Value: "shared"},
+		{Path: "_acme-challenge.other.example.net.", Value: "other"},
+	}
+	if err := r.CreateChallenges(challenges); err != nil {
+		t.Fatal(err)
+	}
+
+	// one change per hosted zone and role
+	var zones []string
+	for _, input := range svc.changes {
+		zones = append(zones, aws.StringValue(input.HostedZoneId))
+	}
+	if strings.Join(zones, ",") != "ZORG,ZCOM,ZNET,ZNET" {
+		t.Errorf("unexpected changes of hosted zones %v", zones)
+	}
+	var changes []string
+	for _, c := range svc.calls {
+		if c.operation == "ChangeResourceRecordSets" {
+			changes = append(changes, c.role)
+		}
+	}
+	if strings.Join(changes, ",") != ",,,arn:aws:iam::111111111111:role/other" {
+		t.Errorf("unexpected roles of changes %q", changes)
+	}
+	if got := records(svc.changes, "ZORG"); len(got) != 2 {
+		t.Errorf("expected both records in one change, got %v", got)
+	}
+}
+
+func TestCreateChallengesRollback(t *testing.T) {
+	svc := newFakeRoute53(
+		hostedZone("ZORG", "example.org", false),
+		hostedZone("ZCOM", "example.com", false),
+	)
+	svc.failZones["ZCOM"] = "UPSERT"
+	r, _ := newProvider(svc, nil)
+
+	challenges := []provider.Challenge{
+		{Path: "_acme-challenge.example.org.", Value: "org"},
+		{Path: "_acme-challenge.example.com.", Value: "com"},
+	}
+	if err := r.CreateChallenges(challenges); err == nil || !strings.Contains(err.Error(), "change rejected") {
+		t.Fatalf("expected rejected change, got %v", err)
+	}
+
+	// the records of the first hosted zone are removed again
+	expected := []string{
+		`UPSERT _acme-challenge.example.org. "org"`,
+		`DELETE _acme-challenge.example.org. "org"`,
+	}
+	if got := records(svc.changes, "ZORG"); strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected records %v, got %v", expected, got)
+	}
+	if got := records(svc.changes, "ZCOM"); len(got) != 0 {
+		t.Errorf("unexpected records %v", got)
+	}
+
+	// no change is pending
+	if err := r.WaitForChallenges(challenges[:1]); err == nil {
+		t.Error("rolled back change is pending")
+	}
+}
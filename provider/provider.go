@@ -16,7 +16,34 @@ limitations under the License.
 
 package provider
 
+// Provider fulfils dns-01 challenges by publishing the challenge token as TXT
+// record under path (e.g. "_acme-challenge.example.com.").
 type Provider interface {
-	CreateChallenge(path string, challenge string)
-	RemoveChallenge(path string, challenge string)
+	// CreateChallenge publishes the challenge record
+	CreateChallenge(path string, challenge string) error
+	// WaitForPropagation blocks until the record, created with
+	// CreateChallenge, is visible to the acme server
+	WaitForPropagation(path string, challenge string) error
+	// RemoveChallenge removes the challenge record
+	RemoveChallenge(path string, challenge string) error
+}
+
+// Challenge is a challenge record with the challenge token value under path
+type Challenge struct {
+	Path  string
+	Value string
+}
+
+// BatchProvider is a Provider, which fulfils several dns-01 challenges at
+// once. Challenges with the same path (e.g. for a wildcard and its apex
+// domain) are published as one record with multiple values.
+type BatchProvider interface {
+	Provider
+	// CreateChallenges publishes all challenge records
+	CreateChallenges(challenges []Challenge) error
+	// WaitForChallenges blocks until the records, created with
+	// CreateChallenges, are visible to the acme server
+	WaitForChallenges(challenges []Challenge) error
+	// RemoveChallenges removes all challenge records
+	RemoveChallenges(challenges []Challenge) error
 }
@@ -27,10 +27,20 @@ import (
 )
 
 func GetSecret(arn *string) *string {
+	return getSecretVersion(arn, "AWSCURRENT")
+}
+
+// GetPreviousSecret returns the previous value of the secret arn (version
+// stage AWSPREVIOUS), e.g. after a rotation
+func GetPreviousSecret(arn *string) *string {
+	return getSecretVersion(arn, "AWSPREVIOUS")
+}
+
+func getSecretVersion(arn *string, stage string) *string {
 	svc := secretsmanager.New(awshelper.GetAwsSession())
 	input := &secretsmanager.GetSecretValueInput{
 		SecretId:     arn,
-		VersionStage: aws.String("AWSCURRENT"),
+		VersionStage: aws.String(stage),
 	}
 
 	result, err := svc.GetSecretValue(input)
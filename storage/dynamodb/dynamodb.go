@@ -0,0 +1,461 @@
+/*
+Copyright 2020 Lars Eric Scheidler
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dynamodb
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	//"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+
+	"github.com/lscheidler/letsencrypt-lambda/account"
+	"github.com/lscheidler/letsencrypt-lambda/account/certificate"
+	//"github.com/lscheidler/letsencrypt-lambda/crypto"
+	awshelper "github.com/lscheidler/letsencrypt-lambda/helper/aws"
+	"github.com/lscheidler/letsencrypt-lambda/storage"
+)
+
+const (
+	// SchemaVersion of the registration item. Items without SchemaVersion
+	// store the whole encrypted account in attribute Data.
+	SchemaVersion = 2
+
+	certificateKeyPrefix = "cert#"
+)
+
+// DynamoDB stores the account in a registration item (key <email>) and one
+// item per certificate (key cert#<email>#<name>). The registration is
+// encrypted with the issuer passphrase, a certificate with the client
+// passphrase. Certificate items have plaintext metadata (Account, Name,
+// Domains, KeyType, NotAfter, Serial, Revoked) for queries.
+type DynamoDB struct {
+	svc       dynamodbiface.DynamoDBAPI
+	tableName *string
+	options   *TableOptions
+
+	mutex sync.Mutex
+	// leases are the owner ids of the acquired leases per email
+	leases map[string]string
+	// versions of the loaded items per key, 0 for items without version
+	// attribute
+	versions map[string]int64
+	// hashes of the loaded certificates per key
+	hashes map[string]string
+}
+
+// New returns the DynamoDB storage for table tableName (default
+// LetsencryptCA). The table is created with options, if it doesn't exist.
+// options nil uses DefaultTableOptions.
+func New(tableName *string, options *TableOptions) *DynamoDB {
+	log.Println("Initialize database connection")
+	sess, conf := awshelper.GetAwsSession()
+	return NewWithClient(dynamodb.New(sess, conf), tableName, options)
+}
+
+// NewWithClient returns the DynamoDB storage, which uses svc (e.g. a fake of
+// the DynamoDB API)
+func NewWithClient(svc dynamodbiface.DynamoDBAPI, tableName *string, options *TableOptions) *DynamoDB {
+	if options == nil {
+		options = DefaultTableOptions()
+	}
+	d := &DynamoDB{
+		svc:       svc,
+		options:   options,
+		tableName: tableName,
+		leases:    map[string]string{},
+		versions:  map[string]int64{},
+		hashes:    map[string]string{},
+	}
+	if d.tableName == nil {
+		defaultTableName := "LetsencryptCA"
+		d.tableName = &defaultTableName
+	}
+	return d
+}
+
+// Load loads the registration item and the certificate items of the account.
+// Items of the previous schema (whole account encrypted in attribute Data)
+// are loaded as well and migrated with the next Save. If the table doesn't
+// exist, it is created, unless auto creation is disabled.
+func (d *DynamoDB) Load(acc *account.Account) error {
+	item, err := d.getItem(*acc.Email)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeResourceNotFoundException {
+			// Table doesn't exist
+			log.Println(dynamodb.ErrCodeResourceNotFoundException, aerr.Error())
+			if err = d.createTableIfEnabled(); err != nil {
+				log.Println(err)
+				return err
+			}
+			return storage.ErrNotFound
+		}
+		printError(err)
+		return err
+	} else if item == nil || (item["Data"] == nil && item["Registration"] == nil) {
+		log.Println("Item not found")
+		// item doesn't exist
+		return storage.ErrNotFound
+	}
+
+	log.Println("Item found")
+	if item["Data"] != nil {
+		log.Println("Item has the previous schema, it is migrated on save")
+		if err := storage.Unmarshal([]byte(*item["Data"].S), acc); err != nil {
+			return err
+		}
+		// write the items of the current schema
+		acc.Changed = true
+		return nil
+	}
+
+	if err := acc.UnmarshalRegistration([]byte(*item["Registration"].S)); err != nil {
+		return err
+	}
+
+	if names := item["CertificateNames"]; names != nil {
+		for _, name := range names.L {
+			if err := d.loadCertificate(acc, *name.S); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (d *DynamoDB) loadCertificate(acc *account.Account, name string) error {
+	key := certificateKey(acc, name)
+	item, err := d.getItem(key)
+	if err != nil {
+		printError(err)
+		return err
+	} else if item == nil || item["Data"] == nil {
+		return fmt.Errorf("certificate item %s not found", key)
+	}
+
+	stale, err := acc.UnmarshalCertificate(name, []byte(*item["Data"].S))
+	if err != nil {
+		return fmt.Errorf("certificate %s: %v", name, err)
+	} else if stale {
+		// written again with the current passphrase or format
+		return nil
+	}
+
+	hash, err := certificateHash(acc.Certificates[name])
+	if err != nil {
+		return err
+	}
+	d.mutex.Lock()
+	d.hashes[key] = hash
+	d.mutex.Unlock()
+	return nil
+}
+
+// Save writes the changed certificate items and the registration item. Items
+// are updated, if their version is still the loaded version. Otherwise it
+// returns storage.ErrConflict. Certificate items are never deleted, the
+// account keeps certificates, which were removed from the configuration
+// (e.g. to revoke them).
+func (d *DynamoDB) Save(acc *account.Account) error {
+	names := []string{}
+	for name := range acc.Certificates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// certificate items are written first, so the registration item never
+	// references missing certificate items
+	var nameValues []*dynamodb.AttributeValue
+	for _, name := range names {
+		if err := d.saveCertificate(acc, name); err != nil {
+			return fmt.Errorf("certificate %s: %v", name, err)
+		}
+		nameValues = append(nameValues, &dynamodb.AttributeValue{S: aws.String(name)})
+	}
+
+	registration, err := acc.MarshalRegistration()
+	if err != nil {
+		return err
+	}
+
+	return d.updateItem(*acc.Email, map[string]*dynamodb.AttributeValue{
+		"Registration": {
+			S: aws.String(string(registration)),
+		},
+		"CertificateNames": {
+			L: nameValues,
+		},
+		"SchemaVersion": {
+			N: aws.String(strconv.Itoa(SchemaVersion)),
+		},
+	}, []string{"Data"})
+}
+
+// saveCertificate writes the certificate item, if the certificate was changed
+// since it was loaded
+func (d *DynamoDB) saveCertificate(acc *account.Account, name string) error {
+	cert := acc.Certificates[name]
+	key := certificateKey(acc, name)
+
+	hash, err := certificateHash(cert)
+	if err != nil {
+		return err
+	}
+	d.mutex.Lock()
+	unchanged := d.hashes[key] == hash
+	d.mutex.Unlock()
+	if unchanged {
+		return nil
+	}
+
+	data, err := acc.MarshalCertificate(name)
+	if err != nil {
+		return err
+	}
+
+	attributes := map[string]*dynamodb.AttributeValue{
+		"Account": {
+			S: acc.Email,
+		},
+		"Name": {
+			S: aws.String(name),
+		},
+		"Domains": {
+			SS: aws.StringSlice(uniqueStrings(cert.Domains)),
+		},
+		"Data": {
+			S: aws.String(string(data)),
+		},
+	}
+	if cert.Key != nil {
+		attributes["KeyType"] = &dynamodb.AttributeValue{S: aws.String(string(cert.Key.Type))}
+	}
+	if !cert.NotAfter.IsZero() {
+		attributes["NotAfter"] = &dynamodb.AttributeValue{S: aws.String(cert.NotAfter.UTC().Format(time.RFC3339))}
+	}
+	if leaf, err := cert.Leaf(); err == nil {
+		attributes["Serial"] = &dynamodb.AttributeValue{S: aws.String(fmt.Sprintf("%x", leaf.SerialNumber))}
+	}
+	attributes["Revoked"] = &dynamodb.AttributeValue{BOOL: aws.Bool(cert.IsRevoked())}
+
+	if err := d.updateItem(key, attributes, nil); err != nil {
+		return err
+	}
+
+	d.mutex.Lock()
+	d.hashes[key] = hash
+	d.mutex.Unlock()
+	return nil
+}
+
+// List returns the emails of the registration items (and items of the
+// previous schema)
+func (d *DynamoDB) List() ([]string, error) {
+	input := &dynamodb.ScanInput{
+		ConsistentRead: aws.Bool(true),
+		ExpressionAttributeNames: map[string]*string{
+			"#K": aws.String("Email"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":cert": {
+				S: aws.String(certificateKeyPrefix),
+			},
+			":lease": {
+				S: aws.String(leaseKeyPrefix),
+			},
+		},
+		FilterExpression:     aws.String("NOT begins_with(#K, :cert) AND NOT begins_with(#K, :lease)"),
+		ProjectionExpression: aws.String("#K"),
+		TableName:            d.tableName,
+	}
+
+	emails := []string{}
+	err := d.svc.ScanPages(input, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			emails = append(emails, *item["Email"].S)
+		}
+		return true
+	})
+	if err != nil {
+		printError(err)
+		return nil, err
+	}
+	sort.Strings(emails)
+	return emails, nil
+}
+
+func (d *DynamoDB) getItem(key string) (map[string]*dynamodb.AttributeValue, error) {
+	input := &dynamodb.GetItemInput{
+		ConsistentRead: aws.Bool(true),
+		Key: map[string]*dynamodb.AttributeValue{
+			"Email": {
+				S: aws.String(key),
+			},
+		},
+		TableName: d.tableName,
+	}
+
+	result, err := d.svc.GetItem(input)
+	if err != nil {
+		return nil, err
+	}
+	if result.Item == nil {
+		return nil, nil
+	}
+
+	var version int64
+	if v := result.Item["Version"]; v != nil && v.N != nil {
+		if version, err = strconv.ParseInt(*v.N, 10, 64); err != nil {
+			return nil, err
+		}
+	}
+
+	d.mutex.Lock()
+	d.versions[key] = version
+	d.mutex.Unlock()
+	return result.Item, nil
+}
+
+// updateItem sets the attributes and removes the attributes remove of the
+// item key, if the version of the item is still the loaded version.
+// Otherwise it returns storage.ErrConflict.
+func (d *DynamoDB) updateItem(key string, attributes map[string]*dynamodb.AttributeValue, remove []string) error {
+	d.mutex.Lock()
+	version, loaded := d.versions[key]
+	d.mutex.Unlock()
+
+	names := map[string]*string{
+		"#V": aws.String("Version"),
+	}
+	values := map[string]*dynamodb.AttributeValue{
+		":next": {
+			N: aws.String(strconv.FormatInt(version+1, 10)),
+		},
+	}
+
+	attributeNames := []string{}
+	for name := range attributes {
+		attributeNames = append(attributeNames, name)
+	}
+	sort.Strings(attributeNames)
+
+	var set []string
+	for index, name := range attributeNames {
+		names[fmt.Sprintf("#a%d", index)] = aws.String(name)
+		values[fmt.Sprintf(":a%d", index)] = attributes[name]
+		set = append(set, fmt.Sprintf("#a%d = :a%d", index, index))
+	}
+	set = append(set, "#V = :next")
+	updateExpression := "SET " + strings.Join(set, ", ")
+
+	if len(remove) > 0 {
+		var removeNames []string
+		for index, name := range remove {
+			names[fmt.Sprintf("#r%d", index)] = aws.String(name)
+			removeNames = append(removeNames, fmt.Sprintf("#r%d", index))
+		}
+		updateExpression += " REMOVE " + strings.Join(removeNames, ", ")
+	}
+
+	var condition string
+	switch {
+	case !loaded:
+		names["#K"] = aws.String("Email")
+		condition = "attribute_not_exists(#K)"
+	case version == 0:
+		// item was written by a previous version without version attribute
+		condition = "attribute_not_exists(#V)"
+	default:
+		condition = "#V = :v"
+		values[":v"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(version, 10))}
+	}
+
+	input := &dynamodb.UpdateItemInput{
+		ConditionExpression:       aws.String(condition),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+		Key: map[string]*dynamodb.AttributeValue{
+			"Email": {
+				S: aws.String(key),
+			},
+		},
+		TableName:        d.tableName,
+		UpdateExpression: aws.String(updateExpression),
+	}
+
+	if _, err := d.svc.UpdateItem(input); err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return storage.ErrConflict
+		}
+		printError(err)
+		return err
+	}
+
+	d.mutex.Lock()
+	d.versions[key] = version + 1
+	d.mutex.Unlock()
+	return nil
+}
+
+// certificateKey returns the key of the certificate item
+func certificateKey(acc *account.Account, name string) string {
+	return certificateKeyPrefix + *acc.Email + "#" + name
+}
+
+// certificateHash returns the hash of the plaintext certificate, to detect
+// changes
+func certificateHash(cert *certificate.Certificate) (string, error) {
+	plaintext, err := json.Marshal(cert)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(plaintext)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+func uniqueStrings(values []string) []string {
+	seen := map[string]bool{}
+	var result []string
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			result = append(result, value)
+		}
+	}
+	return result
+}
+
+func printError(err error) {
+	if aerr, ok := err.(awserr.Error); ok {
+		log.Println(aerr.Code(), aerr.Error())
+	} else {
+		// Print the error, cast err to awserr.Error to get the Code and
+		// Message from an error.
+		log.Println(err.Error())
+	}
+}
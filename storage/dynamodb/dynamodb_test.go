@@ -0,0 +1,362 @@
+/*
+Copyright 2020 Lars Eric Scheidler
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dynamodb
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+
+	"github.com/lscheidler/letsencrypt-lambda/account"
+	"github.com/lscheidler/letsencrypt-lambda/account/certificate"
+	"github.com/lscheidler/letsencrypt-lambda/storage"
+)
+
+// fakeDynamoDB is a local fake of the DynamoDB API for a table with hash key
+// Email. It evaluates the condition and update expressions, which are used
+// by this package.
+type fakeDynamoDB struct {
+	dynamodbiface.DynamoDBAPI
+
+	mutex sync.Mutex
+	items map[string]map[string]*dynamodb.AttributeValue
+	// updates are the keys of the updated items
+	updates []string
+
+	// ttlStatus is the time to live status of the table, ttlErr is
+	// returned by UpdateTimeToLive
+	ttlStatus  string
+	ttlErr     error
+	ttlUpdates int
+}
+
+func newFakeDynamoDB() *fakeDynamoDB {
+	return &fakeDynamoDB{
+		items:     map[string]map[string]*dynamodb.AttributeValue{},
+		ttlStatus: dynamodb.TimeToLiveStatusDisabled,
+	}
+}
+
+func (f *fakeDynamoDB) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return &dynamodb.GetItemOutput{Item: f.items[*input.Key["Email"].S]}, nil
+}
+
+func (f *fakeDynamoDB) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	key := *input.Item["Email"].S
+	if !f.check(f.items[key], input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues) {
+		return nil, conditionalCheckFailed()
+	}
+	f.items[key] = input.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (f *fakeDynamoDB) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	key := *input.Key["Email"].S
+	item := f.items[key]
+	if !f.check(item, input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues) {
+		return nil, conditionalCheckFailed()
+	}
+
+	updated := map[string]*dynamodb.AttributeValue{"Email": {S: aws.String(key)}}
+	for name, value := range item {
+		updated[name] = value
+	}
+
+	expression := *input.UpdateExpression
+	var remove string
+	if index := strings.Index(expression, " REMOVE "); index >= 0 {
+		expression, remove = expression[:index], expression[index+len(" REMOVE "):]
+	}
+	for _, assignment := range strings.Split(strings.TrimPrefix(expression, "SET "), ", ") {
+		parts := strings.SplitN(assignment, " = ", 2)
+		updated[*input.ExpressionAttributeNames[parts[0]]] = input.ExpressionAttributeValues[parts[1]]
+	}
+	if remove != "" {
+		for _, name := range strings.Split(remove, ", ") {
+			delete(updated, *input.ExpressionAttributeNames[name])
+		}
+	}
+
+	f.items[key] = updated
+	f.updates = append(f.updates, key)
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+func (f *fakeDynamoDB) DeleteItem(input *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	key := *input.Key["Email"].S
+	if !f.check(f.items[key], input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues) {
+		return nil, conditionalCheckFailed()
+	}
+	delete(f.items, key)
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+// check evaluates condition, which consists of terms joined by OR. A term is
+// attribute_not_exists(name), name = value or name < value (numbers).
+func (f *fakeDynamoDB) check(item map[string]*dynamodb.AttributeValue, condition *string, names map[string]*string, values map[string]*dynamodb.AttributeValue) bool {
+	if condition == nil {
+		return true
+	}
+
+	for _, term := range strings.Split(*condition, " OR ") {
+		if strings.HasPrefix(term, "attribute_not_exists(") {
+			name := *names[strings.TrimSuffix(strings.TrimPrefix(term, "attribute_not_exists("), ")")]
+			if item[name] == nil {
+				return true
+			}
+			continue
+		}
+
+		for _, operator := range []string{" = ", " < "} {
+			parts := strings.SplitN(term, operator, 2)
+			if len(parts) != 2 {
+				continue
+			}
+			current, value := item[*names[parts[0]]], values[parts[1]]
+			if current == nil {
+				break
+			}
+			switch operator {
+			case " = ":
+				if current.String() == value.String() {
+					return true
+				}
+			case " < ":
+				a, _ := strconv.ParseInt(aws.StringValue(current.N), 10, 64)
+				b, _ := strconv.ParseInt(aws.StringValue(value.N), 10, 64)
+				if a < b {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// updated returns the number of updates of the item key
+func (f *fakeDynamoDB) updated(key string) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	count := 0
+	for _, updated := range f.updates {
+		if updated == key {
+			count++
+		}
+	}
+	return count
+}
+
+func conditionalCheckFailed() error {
+	return awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "The conditional request failed", nil)
+}
+
+const (
+	testEmail          = "user@example.org"
+	testCertificateKey = "cert#user@example.org#example.org"
+)
+
+func newAccount() *account.Account {
+	os.Setenv("ISSUER_PASSPHRASE", "issuer")
+	acc := account.New(aws.String(testEmail), nil, nil)
+	acc.ClientPassphrase = aws.String("client")
+	return acc
+}
+
+func newCertificate() *certificate.Certificate {
+	return &certificate.Certificate{
+		Domains:  []string{"example.org", "*.example.org"},
+		NotAfter: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+}
+
+func TestMigrateLegacyItem(t *testing.T) {
+	fake := newFakeDynamoDB()
+
+	legacy := newAccount()
+	legacy.Certificates["example.org"] = newCertificate()
+	data, err := storage.Marshal(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.items[testEmail] = map[string]*dynamodb.AttributeValue{
+		"Email": {S: aws.String(testEmail)},
+		"Data":  {S: aws.String(string(data))},
+	}
+
+	d := NewWithClient(fake, nil, nil)
+	acc := newAccount()
+	if err := d.Load(acc); err != nil {
+		t.Fatal(err)
+	}
+	if !acc.Changed || acc.Certificates["example.org"] == nil {
+		t.Fatalf("legacy item wasn't loaded for migration (changed %v)", acc.Changed)
+	}
+	if err := d.Save(acc); err != nil {
+		t.Fatal(err)
+	}
+
+	item := fake.items[testEmail]
+	if item["Data"] != nil {
+		t.Error("attribute Data wasn't removed")
+	}
+	if item["Registration"] == nil || aws.StringValue(item["SchemaVersion"].N) != strconv.Itoa(SchemaVersion) {
+		t.Errorf("registration item wasn't written: %v", item)
+	}
+	if names := item["CertificateNames"].L; len(names) != 1 || *names[0].S != "example.org" {
+		t.Errorf("unexpected certificate names %v", names)
+	}
+
+	certItem := fake.items[testCertificateKey]
+	if certItem == nil {
+		t.Fatal("certificate item wasn't written")
+	}
+	if aws.StringValue(certItem["Account"].S) != testEmail || aws.StringValue(certItem["NotAfter"].S) != "2030-01-01T00:00:00Z" || len(certItem["Domains"].SS) != 2 {
+		t.Errorf("unexpected certificate metadata %v", certItem)
+	}
+
+	// the migrated items are loaded with the current schema
+	migrated := newAccount()
+	if err := NewWithClient(fake, nil, nil).Load(migrated); err != nil {
+		t.Fatal(err)
+	}
+	if migrated.Changed || migrated.Certificates["example.org"] == nil {
+		t.Errorf("migrated account wasn't loaded (changed %v)", migrated.Changed)
+	}
+}
+
+func TestSaveOnlyChangedCertificates(t *testing.T) {
+	fake := newFakeDynamoDB()
+
+	acc := newAccount()
+	acc.Certificates["example.org"] = newCertificate()
+	if err := NewWithClient(fake, nil, nil).Save(acc); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewWithClient(fake, nil, nil)
+	loaded := newAccount()
+	if err := d.Load(loaded); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Save(loaded); err != nil {
+		t.Fatal(err)
+	}
+	if updates := fake.updated(testCertificateKey); updates != 1 {
+		t.Errorf("unchanged certificate was written again, %d updates", updates)
+	}
+
+	loaded.Certificates["example.org"].NotAfter = time.Date(2031, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := d.Save(loaded); err != nil {
+		t.Fatal(err)
+	}
+	if updates := fake.updated(testCertificateKey); updates != 2 {
+		t.Errorf("changed certificate wasn't written, %d updates", updates)
+	}
+}
+
+func TestSaveStaleCertificates(t *testing.T) {
+	defer os.Unsetenv("CLIENT_PASSPHRASE")
+	defer os.Unsetenv("CLIENT_PASSPHRASE_PREVIOUS")
+	fake := newFakeDynamoDB()
+
+	os.Setenv("CLIENT_PASSPHRASE", "previous")
+	acc := newAccount()
+	acc.ClientPassphrase = nil
+	acc.Certificates["example.org"] = newCertificate()
+	if err := NewWithClient(fake, nil, nil).Save(acc); err != nil {
+		t.Fatal(err)
+	}
+
+	// after the rotation the certificate is decrypted with the previous
+	// passphrase and encrypted again with the current passphrase
+	os.Setenv("CLIENT_PASSPHRASE", "current")
+	os.Setenv("CLIENT_PASSPHRASE_PREVIOUS", "previous")
+	d := NewWithClient(fake, nil, nil)
+	rotated := newAccount()
+	rotated.ClientPassphrase = nil
+	if err := d.Load(rotated); err != nil {
+		t.Fatal(err)
+	}
+	if !rotated.Changed {
+		t.Error("account with stale certificate isn't changed")
+	}
+	if err := d.Save(rotated); err != nil {
+		t.Fatal(err)
+	}
+	if updates := fake.updated(testCertificateKey); updates != 2 {
+		t.Errorf("stale certificate wasn't written, %d updates", updates)
+	}
+
+	os.Unsetenv("CLIENT_PASSPHRASE_PREVIOUS")
+	current := newAccount()
+	current.ClientPassphrase = nil
+	if err := NewWithClient(fake, nil, nil).Load(current); err != nil {
+		t.Fatalf("certificate isn't encrypted with the current passphrase: %v", err)
+	}
+}
+
+func TestSaveConflict(t *testing.T) {
+	fake := newFakeDynamoDB()
+
+	if err := NewWithClient(fake, nil, nil).Save(newAccount()); err != nil {
+		t.Fatal(err)
+	}
+	// the item was created by another run
+	if err := NewWithClient(fake, nil, nil).Save(newAccount()); err != storage.ErrConflict {
+		t.Errorf("expected %v for a new item, got %v", storage.ErrConflict, err)
+	}
+
+	first, second := NewWithClient(fake, nil, nil), NewWithClient(fake, nil, nil)
+	firstAcc, secondAcc := newAccount(), newAccount()
+	if err := first.Load(firstAcc); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Load(secondAcc); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Save(secondAcc); err != nil {
+		t.Fatal(err)
+	}
+	if version := aws.StringValue(fake.items[testEmail]["Version"].N); version != "2" {
+		t.Errorf("expected version 2, got %s", version)
+	}
+
+	// the version was incremented since it was loaded
+	if err := first.Save(firstAcc); err != storage.ErrConflict {
+		t.Errorf("expected %v, got %v", storage.ErrConflict, err)
+	}
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2020 Lars Eric Scheidler
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dynamodb
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+
+	"github.com/lscheidler/letsencrypt-lambda/account"
+	"github.com/lscheidler/letsencrypt-lambda/storage"
+)
+
+const (
+	// LeaseDuration is longer than the maximum lambda timeout, so an expired
+	// lease is never held by a running invocation
+	LeaseDuration = 16 * time.Minute
+
+	leaseKeyPrefix = "lease#"
+)
+
+// Lock acquires a lease for the account. The lease is stored as item with the
+// key lease#<email> and expires after LeaseDuration, if it isn't released
+// (e.g. after a lambda timeout). It returns storage.ErrLocked, if another run
+// holds the lease.
+func (d *DynamoDB) Lock(acc *account.Account) error {
+	owner, err := newLeaseOwner()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	input := &dynamodb.PutItemInput{
+		ConditionExpression: aws.String("attribute_not_exists(#O) OR #E < :now"),
+		ExpressionAttributeNames: map[string]*string{
+			"#E": aws.String("ExpiresAt"),
+			"#O": aws.String("Owner"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":now": {
+				N: aws.String(strconv.FormatInt(now.Unix(), 10)),
+			},
+		},
+		Item: map[string]*dynamodb.AttributeValue{
+			"Email": {
+				S: aws.String(leaseKeyPrefix + *acc.Email),
+			},
+			"Owner": {
+				S: aws.String(owner),
+			},
+			"ExpiresAt": {
+				N: aws.String(strconv.FormatInt(now.Add(LeaseDuration).Unix(), 10)),
+			},
+		},
+		TableName: d.tableName,
+	}
+
+	_, err = d.svc.PutItem(input)
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case dynamodb.ErrCodeConditionalCheckFailedException:
+			return storage.ErrLocked
+		case dynamodb.ErrCodeResourceNotFoundException:
+			// Table doesn't exist
+			log.Println(dynamodb.ErrCodeResourceNotFoundException, aerr.Error())
+			if err = d.createTableIfEnabled(); err != nil {
+				return err
+			}
+			return d.Lock(acc)
+		}
+	}
+	if err != nil {
+		printError(err)
+		return err
+	}
+
+	d.mutex.Lock()
+	d.leases[*acc.Email] = owner
+	d.mutex.Unlock()
+	return nil
+}
+
+// Unlock releases the lease for the account, if it is still owned by this run
+func (d *DynamoDB) Unlock(acc *account.Account) error {
+	d.mutex.Lock()
+	owner, ok := d.leases[*acc.Email]
+	delete(d.leases, *acc.Email)
+	d.mutex.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	input := &dynamodb.DeleteItemInput{
+		ConditionExpression: aws.String("#O = :o"),
+		ExpressionAttributeNames: map[string]*string{
+			"#O": aws.String("Owner"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":o": {
+				S: aws.String(owner),
+			},
+		},
+		Key: map[string]*dynamodb.AttributeValue{
+			"Email": {
+				S: aws.String(leaseKeyPrefix + *acc.Email),
+			},
+		},
+		TableName: d.tableName,
+	}
+
+	_, err := d.svc.DeleteItem(input)
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		log.Println("Lease expired and was acquired by another run")
+		return nil
+	}
+	return err
+}
+
+func newLeaseOwner() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2020 Lars Eric Scheidler
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dynamodb
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+
+	"github.com/lscheidler/letsencrypt-lambda/storage"
+)
+
+func TestLockBlocksSecondRun(t *testing.T) {
+	fake := newFakeDynamoDB()
+	first, second := NewWithClient(fake, nil, nil), NewWithClient(fake, nil, nil)
+	acc := newAccount()
+
+	if err := first.Lock(acc); err != nil {
+		t.Fatal(err)
+	}
+	lease := fake.items[leaseKeyPrefix+testEmail]
+	if lease == nil {
+		t.Fatal("lease item wasn't written")
+	}
+	expiresAt, _ := strconv.ParseInt(*lease["ExpiresAt"].N, 10, 64)
+	if expected := time.Now().Add(LeaseDuration).Unix(); expiresAt < expected-60 || expiresAt > expected {
+		t.Errorf("unexpected expiry %d", expiresAt)
+	}
+
+	if err := second.Lock(acc); err != storage.ErrLocked {
+		t.Errorf("expected %v, got %v", storage.ErrLocked, err)
+	}
+
+	if err := first.Unlock(acc); err != nil {
+		t.Fatal(err)
+	}
+	if fake.items[leaseKeyPrefix+testEmail] != nil {
+		t.Error("lease item wasn't deleted")
+	}
+	if err := second.Lock(acc); err != nil {
+		t.Errorf("lock after unlock failed: %v", err)
+	}
+}
+
+func TestLockExpiredLease(t *testing.T) {
+	fake := newFakeDynamoDB()
+	first, second := NewWithClient(fake, nil, nil), NewWithClient(fake, nil, nil)
+	acc := newAccount()
+
+	if err := first.Lock(acc); err != nil {
+		t.Fatal(err)
+	}
+	// the lease of the first run expired (e.g. after a lambda timeout)
+	fake.items[leaseKeyPrefix+testEmail]["ExpiresAt"].N = aws.String(strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10))
+
+	if err := second.Lock(acc); err != nil {
+		t.Fatalf("expired lease wasn't acquired: %v", err)
+	}
+
+	// the first run doesn't release the lease of the second run
+	if err := first.Unlock(acc); err != nil {
+		t.Fatal(err)
+	}
+	if fake.items[leaseKeyPrefix+testEmail] == nil {
+		t.Error("lease of another run was deleted")
+	}
+}
@@ -0,0 +1,210 @@
+/*
+Copyright 2020 Lars Eric Scheidler
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dynamodb
+
+import (
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// TableOptions are used, when the table is created
+type TableOptions struct {
+	// AutoCreate creates the table, if it doesn't exist
+	AutoCreate bool
+	// BillingMode is PAY_PER_REQUEST or PROVISIONED
+	BillingMode string
+	// ReadCapacityUnits and WriteCapacityUnits of billing mode PROVISIONED
+	ReadCapacityUnits  int64
+	WriteCapacityUnits int64
+	// KMSKeyId enables server-side encryption with the customer managed KMS
+	// key, otherwise the AWS owned key is used
+	KMSKeyId string
+	// PointInTimeRecovery enables continuous backups
+	PointInTimeRecovery bool
+	Tags                map[string]string
+}
+
+// DefaultTableOptions returns the options for an on-demand table, which is
+// created automatically
+func DefaultTableOptions() *TableOptions {
+	return &TableOptions{
+		AutoCreate:         true,
+		BillingMode:        dynamodb.BillingModePayPerRequest,
+		ReadCapacityUnits:  1,
+		WriteCapacityUnits: 1,
+	}
+}
+
+// Validate checks the options
+func (o *TableOptions) Validate() error {
+	switch o.BillingMode {
+	case dynamodb.BillingModePayPerRequest:
+	case dynamodb.BillingModeProvisioned:
+		if o.ReadCapacityUnits < 1 || o.WriteCapacityUnits < 1 {
+			return fmt.Errorf("read and write capacity units must be at least 1 with billing mode %s", o.BillingMode)
+		}
+	default:
+		return fmt.Errorf("unknown billing mode %s", o.BillingMode)
+	}
+	return nil
+}
+
+// CreateTable creates the table with the table options and waits, until it
+// is active. If the table is already being created (e.g. by a concurrent
+// run), it only waits.
+func (d *DynamoDB) CreateTable() error {
+	input := &dynamodb.CreateTableInput{
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{
+				AttributeName: aws.String("Email"),
+				AttributeType: aws.String("S"),
+			},
+		},
+		BillingMode: aws.String(d.options.BillingMode),
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{
+				AttributeName: aws.String("Email"),
+				KeyType:       aws.String("HASH"),
+			},
+		},
+		TableName: d.tableName,
+	}
+	if d.options.BillingMode == dynamodb.BillingModeProvisioned {
+		input.ProvisionedThroughput = &dynamodb.ProvisionedThroughput{
+			ReadCapacityUnits:  aws.Int64(d.options.ReadCapacityUnits),
+			WriteCapacityUnits: aws.Int64(d.options.WriteCapacityUnits),
+		}
+	}
+	if d.options.KMSKeyId != "" {
+		input.SSESpecification = &dynamodb.SSESpecification{
+			Enabled:        aws.Bool(true),
+			KMSMasterKeyId: aws.String(d.options.KMSKeyId),
+			SSEType:        aws.String(dynamodb.SSETypeKms),
+		}
+	}
+	input.Tags = d.tags()
+
+	log.Println("Create table", *d.tableName)
+	if _, err := d.svc.CreateTable(input); err != nil {
+		if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != dynamodb.ErrCodeResourceInUseException {
+			return err
+		}
+		log.Println("Table", *d.tableName, "is already being created")
+	}
+
+	// the waiter succeeds, when the table status is ACTIVE
+	log.Println("Wait for table", *d.tableName)
+	if err := d.svc.WaitUntilTableExists(&dynamodb.DescribeTableInput{TableName: d.tableName}); err != nil {
+		return err
+	}
+
+	// expired leases are removed by dynamodb
+	if err := d.enableTimeToLive(); err != nil {
+		return err
+	}
+
+	if d.options.PointInTimeRecovery {
+		if _, err := d.svc.UpdateContinuousBackups(&dynamodb.UpdateContinuousBackupsInput{
+			PointInTimeRecoverySpecification: &dynamodb.PointInTimeRecoverySpecification{
+				PointInTimeRecoveryEnabled: aws.Bool(true),
+			},
+			TableName: d.tableName,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// enableTimeToLive enables time to live with attribute ExpiresAt, unless it
+// is already enabled (e.g. by a concurrent run)
+func (d *DynamoDB) enableTimeToLive() error {
+	if enabled, err := d.timeToLiveEnabled(); err != nil {
+		return err
+	} else if enabled {
+		log.Println("Time to live of table", *d.tableName, "is already enabled")
+		return nil
+	}
+
+	_, err := d.svc.UpdateTimeToLive(&dynamodb.UpdateTimeToLiveInput{
+		TableName: d.tableName,
+		TimeToLiveSpecification: &dynamodb.TimeToLiveSpecification{
+			AttributeName: aws.String("ExpiresAt"),
+			Enabled:       aws.Bool(true),
+		},
+	})
+	if err != nil {
+		// a concurrent run may have enabled it after the check
+		if enabled, _ := d.timeToLiveEnabled(); enabled {
+			log.Println("Time to live of table", *d.tableName, "was enabled concurrently")
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// timeToLiveEnabled returns true, if time to live is enabled or being
+// enabled
+func (d *DynamoDB) timeToLiveEnabled() (bool, error) {
+	result, err := d.svc.DescribeTimeToLive(&dynamodb.DescribeTimeToLiveInput{TableName: d.tableName})
+	if err != nil {
+		return false, err
+	}
+	if result.TimeToLiveDescription == nil {
+		return false, nil
+	}
+	switch aws.StringValue(result.TimeToLiveDescription.TimeToLiveStatus) {
+	case dynamodb.TimeToLiveStatusEnabled, dynamodb.TimeToLiveStatusEnabling:
+		return true, nil
+	}
+	return false, nil
+}
+
+// createTableIfEnabled creates the missing table, if auto creation is enabled
+func (d *DynamoDB) createTableIfEnabled() error {
+	if !d.options.AutoCreate {
+		return fmt.Errorf("table %s doesn't exist and auto creation is disabled", *d.tableName)
+	}
+	return d.CreateTable()
+}
+
+func (d *DynamoDB) tags() []*dynamodb.Tag {
+	if len(d.options.Tags) == 0 {
+		return nil
+	}
+
+	keys := []string{}
+	for key := range d.options.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var tags []*dynamodb.Tag
+	for _, key := range keys {
+		tags = append(tags, &dynamodb.Tag{
+			Key:   aws.String(key),
+			Value: aws.String(d.options.Tags[key]),
+		})
+	}
+	return tags
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2020 Lars Eric Scheidler
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dynamodb
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func (f *fakeDynamoDB) CreateTable(input *dynamodb.CreateTableInput) (*dynamodb.CreateTableOutput, error) {
+	return &dynamodb.CreateTableOutput{}, nil
+}
+
+func (f *fakeDynamoDB) WaitUntilTableExists(input *dynamodb.DescribeTableInput) error {
+	return nil
+}
+
+func (f *fakeDynamoDB) DescribeTimeToLive(input *dynamodb.DescribeTimeToLiveInput) (*dynamodb.DescribeTimeToLiveOutput, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return &dynamodb.DescribeTimeToLiveOutput{
+		TimeToLiveDescription: &dynamodb.TimeToLiveDescription{TimeToLiveStatus: aws.String(f.ttlStatus)},
+	}, nil
+}
+
+func (f *fakeDynamoDB) UpdateTimeToLive(input *dynamodb.UpdateTimeToLiveInput) (*dynamodb.UpdateTimeToLiveOutput, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.ttlUpdates++
+	if f.ttlErr != nil {
+		return nil, f.ttlErr
+	}
+	f.ttlStatus = dynamodb.TimeToLiveStatusEnabling
+	return &dynamodb.UpdateTimeToLiveOutput{}, nil
+}
+
+func TestCreateTableEnablesTimeToLive(t *testing.T) {
+	fake := newFakeDynamoDB()
+
+	if err := NewWithClient(fake, nil, nil).CreateTable(); err != nil {
+		t.Fatal(err)
+	}
+	if fake.ttlUpdates != 1 || fake.ttlStatus != dynamodb.TimeToLiveStatusEnabling {
+		t.Errorf("time to live wasn't enabled (%d updates, %s)", fake.ttlUpdates, fake.ttlStatus)
+	}
+}
+
+func TestCreateTableWithEnabledTimeToLive(t *testing.T) {
+	for _, status := range []string{dynamodb.TimeToLiveStatusEnabled, dynamodb.TimeToLiveStatusEnabling} {
+		fake := newFakeDynamoDB()
+		fake.ttlStatus = status
+
+		if err := NewWithClient(fake, nil, nil).CreateTable(); err != nil {
+			t.Fatalf("%s: %v", status, err)
+		}
+		if fake.ttlUpdates != 0 {
+			t.Errorf("%s: time to live was enabled again", status)
+		}
+	}
+}
+
+func TestCreateTableTimeToLiveValidationError(t *testing.T) {
+	fake := newFakeDynamoDB()
+	fake.ttlErr = awserr.New("ValidationException", "invalid attribute name", nil)
+
+	if err := NewWithClient(fake, nil, nil).CreateTable(); err != fake.ttlErr {
+		t.Errorf("expected %v, got %v", fake.ttlErr, err)
+	}
+}
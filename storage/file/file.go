@@ -0,0 +1,171 @@
+/*
+Copyright 2020 Lars Eric Scheidler
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package file
+
+import (
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/lscheidler/letsencrypt-lambda/account"
+	"github.com/lscheidler/letsencrypt-lambda/storage"
+)
+
+// File stores the encrypted account data as file <email>.json in a
+// directory. Files are replaced atomically and a lock file prevents
+// concurrent runs for the same account.
+type File struct {
+	directory string
+
+	mutex sync.Mutex
+	locks map[string]*os.File
+}
+
+func New(directory string) *File {
+	return &File{
+		directory: directory,
+		locks:     map[string]*os.File{},
+	}
+}
+
+func (f *File) Load(acc *account.Account) error {
+	data, err := ioutil.ReadFile(f.path(acc, ".json"))
+	if os.IsNotExist(err) {
+		log.Println("File not found")
+		return storage.ErrNotFound
+	} else if err != nil {
+		return err
+	}
+
+	log.Println("File found")
+	return storage.Unmarshal(data, acc)
+}
+
+// Save writes the account data to a temporary file and renames it afterwards,
+// so the file is never partially written
+func (f *File) Save(acc *account.Account) error {
+	data, err := storage.Marshal(acc)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(f.directory, 0700); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(f.directory, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), f.path(acc, ".json")); err != nil {
+		return err
+	}
+	return syncDirectory(f.directory)
+}
+
+// Lock acquires an exclusive lock for the account. It returns
+// storage.ErrLocked, if another process holds the lock.
+func (f *File) Lock(acc *account.Account) error {
+	if err := os.MkdirAll(f.directory, 0700); err != nil {
+		return err
+	}
+
+	lockFile, err := os.OpenFile(f.path(acc, ".lock"), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+
+	if err := lock(lockFile); err != nil {
+		lockFile.Close()
+		return err
+	}
+
+	f.mutex.Lock()
+	f.locks[*acc.Email] = lockFile
+	f.mutex.Unlock()
+	return nil
+}
+
+func (f *File) Unlock(acc *account.Account) error {
+	f.mutex.Lock()
+	lockFile, ok := f.locks[*acc.Email]
+	delete(f.locks, *acc.Email)
+	f.mutex.Unlock()
+
+	if !ok {
+		return nil
+	}
+	if err := unlock(lockFile); err != nil {
+		lockFile.Close()
+		return err
+	}
+	return lockFile.Close()
+}
+
+// List returns the emails of the account files in the directory
+func (f *File) List() ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(f.directory, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	emails := []string{}
+	for _, path := range paths {
+		email, err := url.PathUnescape(strings.TrimSuffix(filepath.Base(path), ".json"))
+		if err != nil {
+			log.Println("Skip file", path, err)
+			continue
+		}
+		emails = append(emails, email)
+	}
+	return emails, nil
+}
+
+func (f *File) path(acc *account.Account, extension string) string {
+	return filepath.Join(f.directory, url.PathEscape(*acc.Email)+extension)
+}
+
+// syncDirectory persists the rename of a file in directory
+func syncDirectory(directory string) error {
+	d, err := os.Open(directory)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	// not supported on all platforms
+	d.Sync()
+	return nil
+}
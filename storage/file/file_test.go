@@ -0,0 +1,137 @@
+/*
+Copyright 2020 Lars Eric Scheidler
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package file
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+
+	"github.com/lscheidler/letsencrypt-lambda/account"
+	"github.com/lscheidler/letsencrypt-lambda/storage"
+)
+
+func newAccount(email string) *account.Account {
+	os.Setenv("ISSUER_PASSPHRASE", "issuer")
+	acc := account.New(aws.String(email), nil, nil)
+	acc.ClientPassphrase = aws.String("client")
+	return acc
+}
+
+func TestLoadNotFound(t *testing.T) {
+	f := New(t.TempDir())
+
+	if err := f.Load(newAccount("user@example.org")); err != storage.ErrNotFound {
+		t.Errorf("expected %v, got %v", storage.ErrNotFound, err)
+	}
+}
+
+func TestSaveAndLoad(t *testing.T) {
+	directory := filepath.Join(t.TempDir(), "data")
+	f := New(directory)
+
+	acc := newAccount("user@example.org")
+	acc.Registration.URI = "https://acme.example.org/account/1"
+	if err := f.Save(acc); err != nil {
+		t.Fatal(err)
+	}
+	acc.Registration.URI = "https://acme.example.org/account/2"
+	if err := f.Save(acc); err != nil {
+		t.Fatal(err)
+	}
+
+	// the temporary files are renamed
+	files, err := ioutil.ReadDir(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name() != "user@example.org.json" {
+		t.Errorf("unexpected files %v", files)
+	}
+
+	loaded := newAccount("user@example.org")
+	if err := f.Load(loaded); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Registration.URI != "https://acme.example.org/account/2" {
+		t.Errorf("unexpected account uri %s", loaded.Registration.URI)
+	}
+}
+
+func TestLock(t *testing.T) {
+	directory := t.TempDir()
+	first := New(directory)
+	second := New(directory)
+	acc := newAccount("user@example.org")
+
+	if err := first.Lock(acc); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Lock(acc); err != storage.ErrLocked {
+		t.Errorf("expected %v, got %v", storage.ErrLocked, err)
+	}
+
+	// other accounts aren't locked
+	if err := second.Lock(newAccount("other@example.org")); err != nil {
+		t.Error(err)
+	}
+
+	if err := first.Unlock(acc); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Lock(acc); err != nil {
+		t.Errorf("lock after unlock failed: %v", err)
+	}
+	if err := second.Unlock(acc); err != nil {
+		t.Error(err)
+	}
+
+	// unlock without lock is a no-op
+	if err := first.Unlock(acc); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestList(t *testing.T) {
+	f := New(t.TempDir())
+
+	for _, email := range []string{"user@example.org", "user+tag@example.org"} {
+		acc := newAccount(email)
+		if err := f.Save(acc); err != nil {
+			t.Fatal(err)
+		}
+		// lock files aren't listed
+		if err := f.Lock(acc); err != nil {
+			t.Fatal(err)
+		}
+		defer f.Unlock(acc)
+	}
+
+	emails, err := f.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(emails)
+	if expected := []string{"user+tag@example.org", "user@example.org"}; !reflect.DeepEqual(emails, expected) {
+		t.Errorf("expected %v, got %v", expected, emails)
+	}
+}
@@ -0,0 +1,70 @@
+/*
+Copyright 2020 Lars Eric Scheidler
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memory
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/lscheidler/letsencrypt-lambda/account"
+	"github.com/lscheidler/letsencrypt-lambda/storage"
+)
+
+// Memory keeps the encrypted account data in memory, e.g. for tests
+type Memory struct {
+	mutex sync.Mutex
+	items map[string][]byte
+}
+
+func New() *Memory {
+	return &Memory{items: map[string][]byte{}}
+}
+
+func (m *Memory) Load(acc *account.Account) error {
+	m.mutex.Lock()
+	data, ok := m.items[*acc.Email]
+	m.mutex.Unlock()
+
+	if !ok {
+		return storage.ErrNotFound
+	}
+	return storage.Unmarshal(data, acc)
+}
+
+func (m *Memory) Save(acc *account.Account) error {
+	data, err := storage.Marshal(acc)
+	if err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	m.items[*acc.Email] = data
+	m.mutex.Unlock()
+	return nil
+}
+
+func (m *Memory) List() ([]string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	emails := []string{}
+	for email := range m.items {
+		emails = append(emails, email)
+	}
+	sort.Strings(emails)
+	return emails, nil
+}
@@ -0,0 +1,176 @@
+/*
+Copyright 2020 Lars Eric Scheidler
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+
+	"github.com/lscheidler/letsencrypt-lambda/account"
+	awshelper "github.com/lscheidler/letsencrypt-lambda/helper/aws"
+	"github.com/lscheidler/letsencrypt-lambda/storage"
+)
+
+const (
+	// error codes of conditional writes
+	errCodePreconditionFailed         = "PreconditionFailed"
+	errCodeConditionalRequestConflict = "ConditionalRequestConflict"
+)
+
+// S3 stores the encrypted account data as object <prefix><email>.json in a
+// bucket. Objects are written conditionally (If-Match with the ETag of the
+// loaded object or If-None-Match for new objects) to avoid lost updates.
+type S3 struct {
+	svc    s3iface.S3API
+	bucket string
+	prefix string
+
+	mutex sync.Mutex
+	etags map[string]string
+}
+
+// New returns a S3 storage backend. endpoint and forcePathStyle can be used
+// for S3 compatible services (e.g. minio).
+func New(bucket string, prefix string, endpoint *string, forcePathStyle bool) *S3 {
+	sess, conf := awshelper.GetAwsSession()
+	if endpoint != nil {
+		conf.Endpoint = endpoint
+	}
+	if forcePathStyle {
+		conf.S3ForcePathStyle = aws.Bool(true)
+	}
+	return NewWithClient(s3.New(sess, conf), bucket, prefix)
+}
+
+func NewWithClient(svc s3iface.S3API, bucket string, prefix string) *S3 {
+	return &S3{
+		svc:    svc,
+		bucket: bucket,
+		prefix: prefix,
+		etags:  map[string]string{},
+	}
+}
+
+func (s *S3) Load(acc *account.Account) error {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(acc)),
+	}
+
+	result, err := s.svc.GetObject(input)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			log.Println("Object not found")
+			return storage.ErrNotFound
+		}
+		return err
+	}
+	defer result.Body.Close()
+
+	data, err := ioutil.ReadAll(result.Body)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	s.etags[*acc.Email] = aws.StringValue(result.ETag)
+	s.mutex.Unlock()
+
+	log.Println("Object found")
+	return storage.Unmarshal(data, acc)
+}
+
+func (s *S3) Save(acc *account.Account) error {
+	data, err := storage.Marshal(acc)
+	if err != nil {
+		return err
+	}
+
+	input := &s3.PutObjectInput{
+		Body:        bytes.NewReader(data),
+		Bucket:      aws.String(s.bucket),
+		ContentType: aws.String("application/json"),
+		Key:         aws.String(s.key(acc)),
+	}
+
+	s.mutex.Lock()
+	etag, loaded := s.etags[*acc.Email]
+	s.mutex.Unlock()
+
+	// the conditional headers aren't part of s3.PutObjectInput in this sdk
+	// version, they are added to the signed request
+	req, result := s.svc.PutObjectRequest(input)
+	if loaded {
+		req.HTTPRequest.Header.Set("If-Match", etag)
+	} else {
+		req.HTTPRequest.Header.Set("If-None-Match", "*")
+	}
+
+	if err := req.Send(); err != nil {
+		if aerr, ok := err.(awserr.Error); ok && (aerr.Code() == errCodePreconditionFailed || aerr.Code() == errCodeConditionalRequestConflict) {
+			return storage.ErrConflict
+		}
+		return err
+	}
+
+	s.mutex.Lock()
+	s.etags[*acc.Email] = aws.StringValue(result.ETag)
+	s.mutex.Unlock()
+	return nil
+}
+
+// List returns the emails of the account objects with the prefix
+func (s *S3) List() ([]string, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(s.prefix),
+	}
+
+	emails := []string{}
+	err := s.svc.ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			key := strings.TrimPrefix(aws.StringValue(object.Key), s.prefix)
+			if strings.Contains(key, "/") || !strings.HasSuffix(key, ".json") {
+				continue
+			}
+			email, err := url.PathUnescape(strings.TrimSuffix(key, ".json"))
+			if err != nil {
+				log.Println("Skip object", aws.StringValue(object.Key), err)
+				continue
+			}
+			emails = append(emails, email)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return emails, nil
+}
+
+func (s *S3) key(acc *account.Account) string {
+	return s.prefix + url.PathEscape(*acc.Email) + ".json"
+}
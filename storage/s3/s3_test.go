@@ -0,0 +1,193 @@
+/*
+Copyright 2020 Lars Eric Scheidler
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"github.com/lscheidler/letsencrypt-lambda/account"
+	"github.com/lscheidler/letsencrypt-lambda/storage"
+)
+
+// fakeS3 is a local stand-in of the S3 API with support for conditional
+// writes (If-Match, If-None-Match)
+type fakeS3 struct {
+	mutex   sync.Mutex
+	objects map[string][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	data, found := f.objects[r.URL.Path]
+	etag := fmt.Sprintf(`"%x"`, md5.Sum(data))
+
+	switch r.Method {
+	case http.MethodGet:
+		if !found {
+			writeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Write(data)
+	case http.MethodPut:
+		if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && (!found || ifMatch != etag) {
+			writeError(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		if r.Header.Get("If-None-Match") == "*" && found {
+			writeError(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		f.objects[r.URL.Path] = body
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, md5.Sum(body)))
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>%s</Code><Message>%s</Message></Error>`, code, code)
+}
+
+func newStorage(t *testing.T) *S3 {
+	server := httptest.NewServer(&fakeS3{objects: map[string][]byte{}})
+	t.Cleanup(server.Close)
+	return newStorageWithServer(server)
+}
+
+func newStorageWithServer(server *httptest.Server) *S3 {
+	sess := session.Must(session.NewSession(&aws.Config{
+		Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+		Endpoint:         aws.String(server.URL),
+		Region:           aws.String("eu-central-1"),
+		S3ForcePathStyle: aws.Bool(true),
+	}))
+	return NewWithClient(s3.New(sess), "bucket", "accounts/")
+}
+
+// passphrases are usable as keys of the ciphertext format without key
+// derivation, which requires 32 characters
+const (
+	issuerPassphrase = "issuer-passphrase-0123456789abcd"
+	clientPassphrase = "client-passphrase-0123456789abcd"
+)
+
+func newAccount() *account.Account {
+	os.Setenv("ISSUER_PASSPHRASE", issuerPassphrase)
+	return account.New(aws.String("user@example.org"), nil, nil)
+}
+
+func TestLoadNotFound(t *testing.T) {
+	s := newStorage(t)
+
+	if err := s.Load(newAccount()); err != storage.ErrNotFound {
+		t.Errorf("expected %v, got %v", storage.ErrNotFound, err)
+	}
+}
+
+func TestSaveAndLoad(t *testing.T) {
+	s := newStorage(t)
+
+	acc := newAccount()
+	acc.ClientPassphrase = aws.String(clientPassphrase)
+	if err := s.Save(acc); err != nil {
+		t.Fatal(err)
+	}
+	// the ETag of the saved object is used for the next save
+	if err := s.Save(acc); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := newAccount()
+	loaded.ClientPassphrase = aws.String(clientPassphrase)
+	if err := s.Load(loaded); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSaveNewConflict(t *testing.T) {
+	server := httptest.NewServer(&fakeS3{objects: map[string][]byte{}})
+	defer server.Close()
+
+	first := newAccount()
+	first.ClientPassphrase = aws.String(clientPassphrase)
+	if err := newStorageWithServer(server).Save(first); err != nil {
+		t.Fatal(err)
+	}
+
+	// If-None-Match fails, if another run created the object
+	second := newAccount()
+	second.ClientPassphrase = aws.String(clientPassphrase)
+	if err := newStorageWithServer(server).Save(second); err != storage.ErrConflict {
+		t.Errorf("expected %v, got %v", storage.ErrConflict, err)
+	}
+}
+
+func TestSaveChangedConflict(t *testing.T) {
+	server := httptest.NewServer(&fakeS3{objects: map[string][]byte{}})
+	defer server.Close()
+
+	acc := newAccount()
+	acc.ClientPassphrase = aws.String(clientPassphrase)
+	if err := newStorageWithServer(server).Save(acc); err != nil {
+		t.Fatal(err)
+	}
+
+	first := newStorageWithServer(server)
+	firstAcc := newAccount()
+	firstAcc.ClientPassphrase = aws.String(clientPassphrase)
+	if err := first.Load(firstAcc); err != nil {
+		t.Fatal(err)
+	}
+
+	second := newStorageWithServer(server)
+	secondAcc := newAccount()
+	secondAcc.ClientPassphrase = aws.String(clientPassphrase)
+	if err := second.Load(secondAcc); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Save(secondAcc); err != nil {
+		t.Fatal(err)
+	}
+
+	// If-Match fails, because the object was changed since it was loaded
+	if err := first.Save(firstAcc); err != storage.ErrConflict {
+		t.Errorf("expected %v, got %v", storage.ErrConflict, err)
+	}
+}
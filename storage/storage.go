@@ -0,0 +1,77 @@
+/*
+Copyright 2020 Lars Eric Scheidler
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/lscheidler/letsencrypt-lambda/account"
+)
+
+var (
+	// ErrNotFound is returned by Load, if the account doesn't exist
+	ErrNotFound = errors.New("account not found")
+	// ErrConflict is returned by Save, if the account was changed
+	// concurrently since it was loaded
+	ErrConflict = errors.New("account was changed concurrently")
+	// ErrLocked is returned by Lock, if another run holds the lock
+	ErrLocked = errors.New("account is locked by another run")
+)
+
+// Storage persists the encrypted account data. Decisions about the account
+// lifecycle (e.g. creating a new account) are up to the caller.
+type Storage interface {
+	// Load loads the account with the email of acc into acc. It returns
+	// ErrNotFound, if the account doesn't exist.
+	Load(acc *account.Account) error
+	// Save persists acc
+	Save(acc *account.Account) error
+}
+
+// Locker is implemented by storage backends, which prevent concurrent runs
+// for the same account
+type Locker interface {
+	// Lock acquires the lock for acc. It returns ErrLocked, if another run
+	// holds the lock.
+	Lock(acc *account.Account) error
+	// Unlock releases the lock for acc
+	Unlock(acc *account.Account) error
+}
+
+// Lister is implemented by storage backends, which can enumerate the stored
+// accounts (e.g. to rotate the passphrases of all accounts)
+type Lister interface {
+	// List returns the emails of all stored accounts
+	List() ([]string, error)
+}
+
+// Marshal returns the encrypted account data of acc
+func Marshal(acc *account.Account) ([]byte, error) {
+	accountcrypt := account.AccountCrypt(*acc)
+	return json.Marshal(&accountcrypt)
+}
+
+// Unmarshal decrypts data into acc
+func Unmarshal(data []byte, acc *account.Account) error {
+	accountcrypt := account.AccountCrypt(*acc)
+	if err := json.Unmarshal(data, &accountcrypt); err != nil {
+		return err
+	}
+	*acc = account.Account(accountcrypt)
+	return nil
+}
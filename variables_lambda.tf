@@ -11,6 +11,22 @@ variable "aws_lambda_function_publish" {
   default = true
 }
 
+variable "acme_ca_bundle" {
+  default = ""
+}
+
+variable "acme_directory_url" {
+  default = "production"
+}
+
+variable "acme_eab_kid" {
+  default = ""
+}
+
+variable "acme_eab_hmac_key" {
+  default = ""
+}
+
 variable "aws_region" {
   default = ""
 }
@@ -19,17 +35,146 @@ variable "aws_assume_role" {
   default = ""
 }
 
-variable "aws_hosted_zone_id" {}
+variable "aws_hosted_zone_id" {
+  default = ""
+}
+
+# map of domains to hosted zone ids, overrides the discovered hosted zones
+variable "aws_hosted_zones" {
+  type    = map(string)
+  default = {}
+}
+
+# map of domains to role arns, which are assumed for route53 api calls
+variable "aws_domain_roles" {
+  type    = map(string)
+  default = {}
+}
+
+# map of hosted zone ids to role arns, which are assumed for route53 record
+# changes. The hosted zones must be set in aws_hosted_zones or
+# aws_hosted_zone_id.
+variable "aws_hosted_zone_roles" {
+  type    = map(string)
+  default = {}
+}
+
+variable "certificates" {
+  type = list(object({
+    name               = string
+    domains            = list(string)
+    key_type           = optional(string, "")
+    renew_before       = optional(string, "")
+    renew_before_ratio = optional(number, 0)
+    disable_ari        = optional(bool, false)
+    key_policy         = optional(string, "")
+    key_max_age        = optional(string, "")
+    acm_export         = optional(bool, false)
+    acm_region         = optional(string, "")
+    dns_provider       = optional(string, "")
+  }))
+
+  default = []
+}
+
 variable "client_passphrase" {}
-variable "domains" {}
+
+variable "domains" {
+  default = ""
+}
+
+variable "cloudflare_api_token" {
+  default = ""
+}
+
+variable "cloudflare_api_url" {
+  default = ""
+}
+
+variable "dns_provider" {
+  default = "route53"
+}
+
+variable "rfc2136_nameserver" {
+  default = ""
+}
+
+variable "rfc2136_zone" {
+  default = ""
+}
+
+variable "rfc2136_tsig_key" {
+  default = ""
+}
+
+variable "rfc2136_tsig_algorithm" {
+  default = ""
+}
+
+variable "rfc2136_tsig_secret" {
+  default = ""
+}
 
 variable "dynamodb_table_name" {
   default = "LetsencryptCA"
 }
 
+variable "dynamodb_auto_create" {
+  default = true
+}
+
+variable "dynamodb_billing_mode" {
+  default = "PAY_PER_REQUEST"
+}
+
+variable "dynamodb_read_capacity_units" {
+  default = 1
+}
+
+variable "dynamodb_write_capacity_units" {
+  default = 1
+}
+
+variable "dynamodb_kms_key_id" {
+  default = ""
+}
+
+variable "dynamodb_point_in_time_recovery" {
+  default = false
+}
+
+variable "dynamodb_tags" {
+  type    = map(string)
+  default = {}
+}
+
 variable "email" {}
 variable "issuer_passphrase" {}
 
+variable "kms_key_id" {
+  default = ""
+}
+
+variable "passphrase_kdf" {
+  default = "scrypt"
+}
+
+variable "strict_encryption" {
+  default = false
+}
+
+variable "s3_bucket" {
+  default = ""
+}
+
+variable "s3_prefix" {
+  default = ""
+}
+
+variable "storage_backend" {
+  default = "dynamodb"
+}
+
 # aws_lambda_alias.letsencrypt-lambda
 variable "aws_lambda_alias_name" {
   default = "dev"